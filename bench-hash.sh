@@ -0,0 +1,16 @@
+# Compare the two pass delimiter scan + xxhash against hashing during the scan, and the
+# SIMD mask scanners where the CPU has them
+set -e
+./build.sh
+INPUT=${1:-measurements.txt}
+for setting in HASH=xxhash HASH=fused SCAN=avx2 SCAN=avx512; do
+    for i in 1 2 3; do
+        START=$(date +%s.%N)
+        if ! env $setting ./solution $INPUT > /dev/null 2>&1; then
+            echo "$setting: not supported"
+            break
+        fi
+        END=$(date +%s.%N)
+        echo "$setting: $(echo "$END $START" | awk '{printf "%.3f", $1 - $2}')s"
+    done
+done
@@ -0,0 +1,16 @@
+# Compare input backends. With COLD=1 the page cache is dropped before each run, needs sudo
+set -e
+./build.sh
+INPUT=${1:-measurements.txt}
+for mode in mmap pread direct uring; do
+    for i in 1 2 3; do
+        if [ -n "$COLD" ]; then
+            sync
+            echo 3 > /proc/sys/vm/drop_caches
+        fi
+        START=$(date +%s.%N)
+        READ_MODE=$mode ./solution $INPUT > /dev/null 2>&1
+        END=$(date +%s.%N)
+        echo "$mode: $(echo "$END $START" | awk '{printf "%.3f", $1 - $2}')s"
+    done
+done
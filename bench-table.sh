@@ -0,0 +1,13 @@
+# Compare the default station table against the compact split layout (-tags compact).
+# Differences show up with many distinct stations: generate with -unique=10000
+set -e
+INPUT=${1:-measurements.txt}
+for tags in "" compact; do
+    TAGS=$tags ./build.sh
+    for i in 1 2 3; do
+        START=$(date +%s.%N)
+        ./solution $INPUT > /dev/null 2>&1
+        END=$(date +%s.%N)
+        echo "${tags:-default}: $(echo "$END $START" | awk '{printf "%.3f", $1 - $2}')s"
+    done
+done
@@ -1,8 +1,5 @@
 set -e
-PROF=
-if [ -f ./solution.prof ]; then
-    echo Compiling with pgo
-    PROF="-pgoprofile ./solution.prof"
-fi
+# cmd/solution/default.pgo, written by go run ./cmd/pgo, is used unless PGO=off
+PGO=${PGO:-auto}
 rm -f ./solution
-go build -gcflags "$PROF -d=inlfuncswithclosures -d=inlstaticinit -d=inlbudgetslack=100000 -d=alignhot -d pgoinline -d=pgoinlinebudget=100000 -d pgodevirtualize -d disablenil" -o ./solution ./cmd/solution/*.go
+go build -tags "$TAGS" -pgo "$PGO" -gcflags "-d=inlfuncswithclosures -d=inlstaticinit -d=inlbudgetslack=100000 -d=alignhot -d pgoinline -d=pgoinlinebudget=100000 -d pgodevirtualize -d disablenil" -o ./solution ./cmd/solution
@@ -0,0 +1,25 @@
+# Runs the solution over generated files that end exactly on a page boundary, where
+# reading past the last record would touch the page after the file
+set -e
+./build.sh
+go build -o ./generate ./cmd/generate
+DIR=$(mktemp -d)
+trap 'rm -rf "$DIR" ./generate' EXIT
+check() {
+    GENERATE_ARGS=$1
+    shift
+    (cd "$DIR" && "$OLDPWD/generate" -pagealign $GENERATE_ARGS ${RECORDS:-100000} > /dev/null)
+    for setting in "$@"; do
+        if env $setting ./solution "$DIR/measurements.txt" > /dev/null 2>&1; then
+            echo "ok: $GENERATE_ARGS $setting"
+        else
+            echo "FAILED: $GENERATE_ARGS $setting"
+            exit 1
+        fi
+    done
+}
+check "" SCAN=swar HASH=fused READ_MODE=pread READ_MODE=uring NUMA=1
+check "-crlf" LINE_ENDING=crlf "LINE_ENDING=crlf HASH=fused"
+check "-delimiter=, -quoted -header" "DELIMITER=, QUOTED=1 HEADER=1"
+check "-timestamps=epoch" TIME_WINDOW=day
+check "-precision=2 -range=999.99" PRECISION=2
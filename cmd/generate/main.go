@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
+	"math"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -27,19 +32,76 @@ func main() {
 			s += int(b)
 		}
 	}
-	if len(os.Args) < 2 {
+	timestamps := flag.String("timestamps", "", "add a timestamp column: epoch or iso")
+	precision := flag.Int("precision", 1, "fractional digits of measurements")
+	valueRange := flag.Float64("range", 99.9, "largest absolute measurement, temperatures are scaled up to it")
+	delimiterFlag := flag.String("delimiter", ";", "field delimiter, \"tab\" for a tab")
+	crlf := flag.Bool("crlf", false, "end lines with \\r\\n")
+	header := flag.Bool("header", false, "start with a header line")
+	quoted := flag.Bool("quoted", false, "wrap all station names in double quotes, not just those containing the delimiter")
+	stationsFile := flag.String("stations", "", "also write the station names to this file, one per line")
+	unique := flag.Int("unique", len(SOURCE_STATIONS), "number of distinct stations, numbered copies of the built in ones beyond those")
+	pageAlign := flag.Bool("pagealign", false, "append records until the file size is a multiple of the page size")
+	flag.Parse()
+	if flag.NArg() < 1 {
 		panic("missing parameter: number of records to create (int)")
 	}
-	count, err := strconv.ParseInt(os.Args[1], 10, 64)
+	count, err := strconv.ParseInt(flag.Arg(0), 10, 64)
 	if err != nil {
 		panic("invalid parameter: number of records to create (int)")
 	}
+	if *unique < 1 {
+		panic("invalid parameter: unique must be at least 1")
+	}
+	stations := expandStations(*unique)
+	if *stationsFile != "" {
+		if err := writeStationList(*stationsFile, stations); err != nil {
+			panic(err)
+		}
+	}
+	delimiter := []byte(parseDelimiter(*delimiterFlag))
+	names, anyQuoted := stationNames(stations, delimiter, *quoted)
+	if anyQuoted && !*quoted {
+		fmt.Println("Some station names contain the delimiter and are quoted, read the file with QUOTED=1")
+	}
+	var writeTimestamp func([]byte, int64, []byte) int
+	switch *timestamps {
+	case "":
+	case "epoch":
+		writeTimestamp = writeEpoch
+	case "iso":
+		writeTimestamp = writeISO
+	default:
+		panic("invalid parameter: timestamps must be epoch or iso")
+	}
 	maxRecordLength := 0
-	maxLengthAfterName := len("-99.9\n")
-	for _, ws := range SOURCE_STATIONS {
-		maxRecordLength = max(maxRecordLength, len(ws.name)+maxLengthAfterName)
+	wide := *precision != 1 || *valueRange != 99.9
+	maxLengthAfterName := len("-99.9\r\n")
+	if wide {
+		maxLengthAfterName = len(strconv.FormatFloat(-*valueRange, 'f', *precision, 64)) + len(".\r\n")
+	}
+	if writeTimestamp != nil {
+		maxLengthAfterName += len("2006-01-02T15:04:05Z") + len(delimiter)
+	}
+	for _, name := range names {
+		maxRecordLength = max(maxRecordLength, len(name)+maxLengthAfterName)
+	}
+	lineEnding := "\n"
+	if *crlf {
+		lineEnding = "\r\n"
+	}
+	headerLine := []byte{}
+	if *header {
+		columns := []string{"station", "measurement"}
+		if writeTimestamp != nil {
+			columns = []string{"station", "timestamp", "measurement"}
+		}
+		headerLine = []byte(strings.Join(columns, string(delimiter)) + lineEnding)
+	}
+	maxFileSize := count*int64(maxRecordLength) + int64(len(headerLine))
+	if *pageAlign {
+		maxFileSize += 3 * int64(os.Getpagesize())
 	}
-	maxFileSize := count * int64(maxRecordLength)
 	f, err := os.Create("measurements.txt")
 	if err != nil {
 		panic(err)
@@ -62,7 +124,7 @@ func main() {
 	}
 	defer syscall.Munmap(data)
 
-	written := 0
+	written := copy(data, headerLine)
 	nextTick := time.Now().Add(time.Second)
 	fmt.Println("Generating measurements.txt...")
 	for i := range count {
@@ -73,16 +135,177 @@ func main() {
 				nextTick = now.Add(time.Second)
 			}
 		}
-		station := SOURCE_STATIONS[fastrand.Int()%len(SOURCE_STATIONS)]
-		written += copy(data[written:], station.name)
+		stationIndex := fastrand.Int() % len(stations)
+		station := stations[stationIndex]
+		written += copy(data[written:], names[stationIndex])
+		if writeTimestamp != nil {
+			written += writeTimestamp(data[written:], TIMESTAMP_START+int64(fastrand.Uint32n(TIMESTAMP_SPAN)), delimiter)
+		}
 		measurement := station.avg + fastrand.Int()%(MEASUREMENT_DIVERGENCE*2+1) - MEASUREMENT_DIVERGENCE
-		measurement = max(-999, min(999, measurement))
-		written += writeMeasurement(data[written:], measurement)
+		if wide {
+			written += writeFixed(data[written:], widen(measurement, *precision, *valueRange), *precision)
+		} else {
+			measurement = max(-999, min(999, measurement))
+			written += writeMeasurement(data[written:], measurement)
+		}
+		if *crlf {
+			data[written-1] = '\r'
+			data[written] = '\n'
+			written++
+		}
+	}
+	if *pageAlign {
+		var timestamp []byte
+		if writeTimestamp != nil {
+			buffer := [64]byte{}
+			timestamp = buffer[:writeTimestamp(buffer[:], TIMESTAMP_START, delimiter)]
+		}
+		shortest := slices.MinFunc(names, func(a, b []byte) int { return len(a) - len(b) })
+		written = padToPage(data, written, shortest, timestamp, *precision, lineEnding)
 	}
 	fmt.Println("\r100.00%")
 	f.Truncate(int64(written))
 }
 
+// Timestamps are spread uniformly over 2024
+const TIMESTAMP_START = 1704067200
+const TIMESTAMP_SPAN = 366 * 86400
+
+func writeEpoch(data []byte, epoch int64, delimiter []byte) int {
+	buffer := [32]byte{}
+	b := strconv.AppendInt(buffer[:0], epoch, 10)
+	b = append(b, delimiter...)
+	return copy(data, b)
+}
+
+func writeISO(data []byte, epoch int64, delimiter []byte) int {
+	buffer := [32]byte{}
+	b := time.Unix(epoch, 0).UTC().AppendFormat(buffer[:0], "2006-01-02T15:04:05Z")
+	b = append(b, delimiter...)
+	return copy(data, b)
+}
+
+// Appends records of one station until written is a multiple of the page size, for
+// checking that parsers don't read past the end of a file that ends on a page boundary.
+// A short name makes the word-at-a-time name scans reach furthest past the last record.
+// Measurements 0, 10 and -10 give records of three consecutive lengths, which can fill
+// any gap that is large enough; smaller gaps are extended by a page.
+func padToPage(data []byte, written int, name []byte, timestamp []byte, precision int, lineEnding string) int {
+	fraction := ""
+	if precision > 0 {
+		fraction = "." + strings.Repeat("0", precision)
+	}
+	measurements := [3]string{"0" + fraction, "10" + fraction, "-10" + fraction}
+	base := len(name) + len(timestamp) + len(measurements[0]) + len(lineEnding)
+	pageSize := os.Getpagesize()
+	gap := (pageSize - written%pageSize) % pageSize
+	if gap == 0 {
+		return written
+	}
+	records := 0
+	for {
+		records = (gap + base + 1) / (base + 2)
+		if records*base <= gap {
+			break
+		}
+		gap += pageSize
+	}
+	extra := gap - records*base
+	for range records {
+		longer := min(2, extra)
+		extra -= longer
+		written += copy(data[written:], name)
+		written += copy(data[written:], timestamp)
+		written += copy(data[written:], measurements[longer])
+		written += copy(data[written:], lineEnding)
+	}
+	return written
+}
+
+func writeStationList(filename string, stations []weatherStationSource) error {
+	list := []byte{}
+	for _, station := range stations {
+		list = append(list, station.name[:len(station.name)-1]...)
+		list = append(list, '\n')
+	}
+	return os.WriteFile(filename, list, 0644)
+}
+
+// The first count of SOURCE_STATIONS, followed by copies numbered "Abha 2", "Abha 3" and
+// so on when count is larger.
+func expandStations(count int) []weatherStationSource {
+	stations := make([]weatherStationSource, count)
+	for i := range stations {
+		source := SOURCE_STATIONS[i%len(SOURCE_STATIONS)]
+		stations[i] = source
+		if copyNumber := i / len(SOURCE_STATIONS); copyNumber > 0 {
+			name := fmt.Sprintf("%s %d;", source.name[:len(source.name)-1], copyNumber+1)
+			stations[i].name = []byte(name)
+		}
+	}
+	return stations
+}
+
+// The same spelling as the solution's DELIMITER: "tab" for a tab, ";" when empty.
+func parseDelimiter(s string) string {
+	switch s {
+	case "":
+		return ";"
+	case "tab":
+		return "\t"
+	}
+	return s
+}
+
+// Station names followed by the delimiter, in stations order. Names are quoted when
+// quoted is set and otherwise only when they contain the delimiter, which they could not
+// be told apart from; the second result says whether any were.
+func stationNames(stations []weatherStationSource, delimiter []byte, quoted bool) ([][]byte, bool) {
+	names := make([][]byte, len(stations))
+	anyQuoted := false
+	for i, station := range stations {
+		name := station.name[:len(station.name)-1]
+		if quoted || bytes.Contains(name, delimiter) {
+			name = []byte(`"` + strings.ReplaceAll(string(name), `"`, `""`) + `"`)
+			anyQuoted = true
+		}
+		names[i] = append(slices.Clip(name), delimiter...)
+	}
+	return names, anyQuoted
+}
+
+// Scales a one decimal measurement to valueRange and precision, filling the extra
+// fractional digits with noise.
+func widen(measurement int, precision int, valueRange float64) int64 {
+	scale := math.Pow10(precision)
+	v := int64(math.Round(float64(measurement) / 10 * (valueRange / 99.9) * scale))
+	if precision > 1 {
+		v += int64(fastrand.Uint32n(uint32(scale / 10)))
+	}
+	limit := int64(math.Round(valueRange * scale))
+	return max(-limit, min(limit, v))
+}
+
+func writeFixed(data []byte, measurement int64, precision int) int {
+	buffer := [32]byte{}
+	b := buffer[:0]
+	if measurement < 0 {
+		b = append(b, '-')
+		measurement = -measurement
+	}
+	digits := strconv.AppendInt(nil, measurement, 10)
+	for len(digits) <= precision {
+		digits = append([]byte{'0'}, digits...)
+	}
+	b = append(b, digits[:len(digits)-precision]...)
+	if precision > 0 {
+		b = append(b, '.')
+		b = append(b, digits[len(digits)-precision:]...)
+	}
+	b = append(b, '\n')
+	return copy(data, b)
+}
+
 func writeMeasurement(data []byte, measurement int) int {
 	measurementBuffer := [6]byte{}
 	bufPos := 0
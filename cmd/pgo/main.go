@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Profile guided build: generates a dataset, profiles a build without PGO on it, writes
+// the profile to cmd/solution/default.pgo, which go build picks up from then on, and
+// compares the build made with it against the one without. Run from the repository
+// root, like build.sh. Options the solution reads from the environment apply to every
+// run, so HASH=fused go run ./cmd/pgo profiles that configuration.
+func main() {
+	rows := flag.Int("rows", 50_000_000, "rows of generated input")
+	input := flag.String("input", "", "profile on this file instead of generating one")
+	runs := flag.Int("runs", 3, "timed runs per build, the fastest counts")
+	keep := flag.Bool("keep", false, "keep the work directory with the dataset, binaries and profile")
+	flag.Parse()
+	if err := pgo(*rows, *input, *runs, *keep); err != nil {
+		fmt.Fprintln(os.Stderr, "pgo:", err)
+		os.Exit(1)
+	}
+}
+
+func pgo(rows int, input string, runs int, keep bool) error {
+	if runs < 1 {
+		return errors.New("invalid parameter: runs must be at least 1")
+	}
+	if _, err := os.Stat("build.sh"); err != nil {
+		return fmt.Errorf("run from the repository root: %w", err)
+	}
+	// Inside the repository rather than under $TMPDIR, so that moving binaries between
+	// it and the repository root never crosses a file system
+	work, err := os.MkdirTemp(".", ".pgo-")
+	if err != nil {
+		return err
+	}
+	if keep {
+		fmt.Fprintln(os.Stderr, "Work directory:", work)
+	} else {
+		defer os.RemoveAll(work)
+	}
+
+	if input == "" {
+		fmt.Fprintf(os.Stderr, "Generating %d rows\n", rows)
+		generator, err := filepath.Abs(filepath.Join(work, "generate"))
+		if err != nil {
+			return err
+		}
+		if err := run(exec.Command("go", "build", "-o", generator, "./cmd/generate")); err != nil {
+			return err
+		}
+		generate := exec.Command(generator, fmt.Sprint(rows))
+		generate.Dir = work
+		if err := run(generate); err != nil {
+			return err
+		}
+		input = filepath.Join(work, "measurements.txt")
+	}
+
+	fmt.Fprintln(os.Stderr, "Building without PGO")
+	baseline, err := build(work, "solution-nopgo", "off")
+	if err != nil {
+		return err
+	}
+	baselineTime, baselineOutput, err := timeRuns(baseline, input, runs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Profiling")
+	profilePath := filepath.Join(work, "cpu.prof")
+	profile := exec.Command(baseline, "-cpuprofile", profilePath, input)
+	profile.Stderr = os.Stderr
+	if err := profile.Run(); err != nil {
+		return fmt.Errorf("%s: %w", profile, err)
+	}
+	prof, err := os.ReadFile(profilePath)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join("cmd", "solution", "default.pgo"), prof, 0o644); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Building with cmd/solution/default.pgo")
+	optimized, err := build(work, "solution-pgo", "auto")
+	if err != nil {
+		return err
+	}
+	optimizedTime, optimizedOutput, err := timeRuns(optimized, input, runs)
+	if err != nil {
+		return err
+	}
+	// Stations come out in table order, which differs between runs
+	if !slices.Equal(sortedLines(baselineOutput), sortedLines(optimizedOutput)) {
+		return errors.New("the PGO build produced different output")
+	}
+	if err := os.Rename(optimized, "solution"); err != nil {
+		return err
+	}
+
+	fmt.Printf("without PGO: %.3fs\n", baselineTime.Seconds())
+	fmt.Printf("with PGO:    %.3fs\n", optimizedTime.Seconds())
+	fmt.Printf("speedup:     %.1f%%\n", 100*(baselineTime.Seconds()/optimizedTime.Seconds()-1))
+	fmt.Println("Wrote cmd/solution/default.pgo and ./solution, commit the profile to keep it")
+	return nil
+}
+
+// Builds with build.sh, so the compiler flags are the same as for normal builds, and
+// moves the result into the work directory.
+func build(work string, name string, pgo string) (string, error) {
+	cmd := exec.Command("sh", "build.sh")
+	cmd.Env = append(os.Environ(), "PGO="+pgo)
+	if err := run(cmd); err != nil {
+		return "", err
+	}
+	path := filepath.Join(work, name)
+	if err := os.Rename("solution", path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Fastest of runs runs, and the output of the last one.
+func timeRuns(binary string, input string, runs int) (time.Duration, []byte, error) {
+	best := time.Duration(0)
+	var output []byte
+	for range runs {
+		cmd := exec.Command(binary, input)
+		start := time.Now()
+		out, err := cmd.Output()
+		elapsed := time.Since(start)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s %s: %w", binary, input, err)
+		}
+		if best == 0 || elapsed < best {
+			best = elapsed
+		}
+		output = out
+	}
+	fmt.Fprintf(os.Stderr, "  %s: %.3fs\n", filepath.Base(binary), best.Seconds())
+	return best, output, nil
+}
+
+func sortedLines(output []byte) []string {
+	lines := strings.Split(string(output), "\n")
+	slices.Sort(lines)
+	return lines
+}
+
+func run(cmd *exec.Cmd) error {
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", cmd, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Room for 1024 CPUs, same as glibc's cpu_set_t
+type cpuMask [16]uint64
+
+func (m *cpuMask) set(cpu int) {
+	m[cpu/64] |= 1 << (cpu % 64)
+}
+
+func (m *cpuMask) has(cpu int) bool {
+	return m[cpu/64]&(1<<(cpu%64)) != 0
+}
+
+// CPUs this process may run on, ascending.
+func AllowedCPUs() ([]int, error) {
+	var mask cpuMask
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return nil, errno
+	}
+	cpus := []int{}
+	for cpu := range len(mask) * 64 {
+		if mask.has(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Binds the calling OS thread to cpu. The goroutine must hold runtime.LockOSThread,
+// otherwise the pin applies to whichever thread it happens to be on.
+func PinThread(cpu int) error {
+	var mask cpuMask
+	mask.set(cpu)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return fmt.Errorf("pin thread to cpu %d: %w", cpu, errno)
+	}
+	return nil
+}
+
+// Keeps only the first hardware thread of each physical core, per
+// /sys/devices/system/cpu/cpuN/topology/thread_siblings_list.
+func WithoutSMTSiblings(cpus []int) ([]int, error) {
+	result := []int{}
+	seen := map[int]bool{}
+	for _, cpu := range cpus {
+		if seen[cpu] {
+			continue
+		}
+		result = append(result, cpu)
+		siblings, err := os.ReadFile(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/topology/thread_siblings_list", cpu))
+		if err != nil {
+			return nil, err
+		}
+		list, err := ParseCPUList(strings.TrimSpace(string(siblings)))
+		if err != nil {
+			return nil, err
+		}
+		for _, sibling := range list {
+			seen[sibling] = true
+		}
+	}
+	return result, nil
+}
+
+// Parses the kernel's list format, e.g. "0-3,8,10-11".
+func ParseCPUList(s string) ([]int, error) {
+	cpus := []int{}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q", s)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil || to < from {
+				return nil, fmt.Errorf("invalid cpu list %q", s)
+			}
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if slices.ContainsFunc(cpus, func(cpu int) bool { return cpu >= len(cpuMask{})*64 }) {
+		return nil, fmt.Errorf("cpu out of range in %q", s)
+	}
+	return cpus, nil
+}
+
+// Locks the calling goroutine to its thread and pins it to the CPU assigned to worker,
+// if the schedule pins at all. Workers beyond len(CPUs) wrap around. The thread is never
+// unlocked, so the runtime discards it when the worker exits instead of reusing it.
+func (s *ScheduleOptions) pinWorker(worker int) error {
+	if len(s.CPUs) == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	return PinThread(s.CPUs[worker%len(s.CPUs)])
+}
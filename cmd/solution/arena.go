@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Where a station's name is in its table's nameArena.
+type nameRef struct {
+	offset, length uint32
+}
+
+// Append-only store for the names in one results table, so that tables hold no Go
+// strings and first sightings cost no heap allocation. Strings are only made at output.
+// The memory is reserved up front and faulted in as names are added.
+type nameArena struct {
+	data []byte
+	used int
+}
+
+// Virtual size of each arena
+const nameArenaSize = 1 << 30
+
+// Node -1 means no NUMA binding.
+func (a *nameArena) init(node int) error {
+	data, err := syscall.Mmap(-1, 0, nameArenaSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_NORESERVE)
+	if err != nil {
+		return fmt.Errorf("name arena: %w", err)
+	}
+	if node >= 0 {
+		if err := Mbind(data, node); err != nil {
+			syscall.Munmap(data)
+			return err
+		}
+	}
+	a.data = data
+	a.used = 0
+	return nil
+}
+
+// Unmaps the arena. Safe to call more than once.
+func (a *nameArena) release() {
+	if a.data != nil {
+		syscall.Munmap(a.data)
+		a.data = nil
+	}
+}
+
+func (a *nameArena) add(name []byte) (nameRef, error) {
+	if a.used+len(name) > len(a.data) {
+		return nameRef{}, &NameArenaFullError{Size: len(a.data)}
+	}
+	ref := nameRef{offset: uint32(a.used), length: uint32(len(name))}
+	a.used += copy(a.data[a.used:], name)
+	return ref, nil
+}
+
+func (a *nameArena) bytes(ref nameRef) []byte {
+	return a.data[ref.offset : ref.offset+ref.length]
+}
+
+func (a *nameArena) String(ref nameRef) string {
+	return string(a.bytes(ref))
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"time"
+)
+
+// Exit statuses
+const (
+	exitOK = 0
+	// Any other failure, e.g. an option with a bad value
+	exitFailure = 1
+	// Bad command line
+	exitUsage          = 2
+	exitInputNotFound  = 3
+	exitNotRegularFile = 4
+	exitMmap           = 5
+	exitHugePages      = 6
+	exitMalformedInput = 7
+)
+
+func exitStatus(err error) int {
+	var mmapErr *MmapError
+	var hugePageErr *HugePageError
+	var malformedErr *MalformedInputError
+	switch {
+	case errors.Is(err, ErrInputNotFound):
+		return exitInputNotFound
+	case errors.Is(err, ErrNotRegularFile):
+		return exitNotRegularFile
+	case errors.As(err, &mmapErr):
+		return exitMmap
+	case errors.As(err, &hugePageErr):
+		return exitHugePages
+	case errors.As(err, &malformedErr):
+		return exitMalformedInput
+	}
+	return exitFailure
+}
+
+// Command line settings. Everything else is read from the environment, see README.md.
+type cliOptions struct {
+	Input  string
+	Format OutputFormat
+	// Zero leaves it to WORKERS or the default
+	Workers int
+	// Empty leaves it to ALLOC or the default
+	Alloc string
+	// Timed runs for bench
+	Runs int
+	// Print a Timings report to stderr
+	Timings bool
+	// Print per-worker hardware counters to stderr, see Counters
+	Counters bool
+	// Show bytes parsed, throughput and ETA on stderr while parsing
+	Progress bool
+
+	CPUProfile   string
+	MemProfile   string
+	BlockProfile string
+	Trace        string
+}
+
+type command struct {
+	name    string
+	summary string
+	run     func(options *cliOptions) error
+}
+
+var commands = []command{
+	{"run", "aggregate the input and print the results (the default command)", runCommand},
+	{"validate", "parse the whole input, printing only whether it is well formed", validateCommand},
+	{"bench", "time complete runs without printing results", benchCommand},
+	{"stats", "print totals for the input: rows, stations, value range, throughput", statsCommand},
+}
+
+// Parses args, runs the command and returns the exit status. The command name may be
+// left out, so "solution measurements.txt" still works.
+func runCLI(args []string) int {
+	cmd := commands[0]
+	if len(args) > 0 {
+		if i := slices.IndexFunc(commands, func(c command) bool { return c.name == args[0] }); i >= 0 {
+			cmd = commands[i]
+			args = args[1:]
+		}
+	}
+
+	options := cliOptions{Input: "measurements.txt"}
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	input := flags.String("input", "", "input file, also accepted as the only argument (default measurements.txt)")
+	format := flags.String("format", "text", "output format: text, csv or json")
+	flags.IntVar(&options.Workers, "workers", 0, "worker goroutines (default WORKERS, or one per CPU)")
+	flags.StringVar(&options.Alloc, "alloc", "", "result table allocation: hugetlb, thp or heap (default ALLOC, or hugetlb)")
+	if cmd.name == "bench" {
+		flags.IntVar(&options.Runs, "runs", 5, "number of timed runs")
+	}
+	flags.BoolVar(&options.Timings, "timings", false, "print per-phase timings and a per-worker skew table to stderr")
+	flags.BoolVar(&options.Counters, "counters", false, "print per-worker hardware counters (IPC, misses per row) to stderr")
+	flags.BoolVar(&options.Progress, "progress", false, "show parsing progress, throughput and ETA on stderr")
+	flags.StringVar(&options.CPUProfile, "cpuprofile", "", "write a CPU profile to `file`")
+	flags.StringVar(&options.MemProfile, "memprofile", "", "write a heap profile to `file` when done")
+	flags.StringVar(&options.BlockProfile, "blockprofile", "", "write a goroutine blocking profile to `file` when done")
+	flags.StringVar(&options.Trace, "trace", "", "write a runtime execution trace to `file`")
+	flags.Usage = func() { usage(flags.Output(), flags) }
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	switch {
+	case flags.NArg() > 1:
+		return usageError(flags, "more than one input given")
+	case flags.NArg() == 1 && *input != "":
+		return usageError(flags, "input given both as -input and as an argument")
+	case flags.NArg() == 1:
+		options.Input = flags.Arg(0)
+	case *input != "":
+		options.Input = *input
+	}
+	var err error
+	if options.Format, err = ParseOutputFormat(*format); err != nil {
+		return usageError(flags, err.Error())
+	}
+	if options.Workers < 0 {
+		return usageError(flags, "-workers must not be negative")
+	}
+	if cmd.name == "bench" && options.Runs < 1 {
+		return usageError(flags, "-runs must be at least 1")
+	}
+
+	stopProfiles, err := startProfiles(&options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "solution:", err)
+		return exitFailure
+	}
+	err = cmd.run(&options)
+	if profileErr := stopProfiles(); err == nil {
+		err = profileErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "solution:", err)
+		return exitStatus(err)
+	}
+	return exitOK
+}
+
+func usage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "Usage: solution [command] [flags] [input]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	flags.PrintDefaults()
+	fmt.Fprintln(w, "\nParser and scheduling options are environment variables, see README.md.")
+}
+
+func usageError(flags *flag.FlagSet, message string) int {
+	fmt.Fprintln(flags.Output(), message)
+	usage(flags.Output(), flags)
+	return exitUsage
+}
+
+// Starts the profiles asked for and returns a function that writes them out.
+func startProfiles(options *cliOptions) (func() error, error) {
+	var stops []func() error
+	stop := func() error {
+		var err error
+		for _, s := range stops {
+			err = errors.Join(err, s())
+		}
+		return err
+	}
+	if options.CPUProfile != "" {
+		f, err := os.Create(options.CPUProfile)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			fmt.Fprintln(os.Stderr, "CPU profile written, run:\ngo tool pprof", os.Args[0], options.CPUProfile)
+			return f.Close()
+		})
+	}
+	if options.Trace != "" {
+		f, err := os.Create(options.Trace)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stop()
+			return nil, err
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+	if options.BlockProfile != "" {
+		runtime.SetBlockProfileRate(1)
+		stops = append(stops, func() error {
+			return writeProfile("block", options.BlockProfile)
+		})
+	}
+	if options.MemProfile != "" {
+		stops = append(stops, func() error {
+			// Collection is off, so bring the live heap up to date first
+			runtime.GC()
+			return writeProfile("heap", options.MemProfile)
+		})
+	}
+	return stop, nil
+}
+
+func writeProfile(name string, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Nil unless -timings was given.
+func (o *cliOptions) newTimings() *Timings {
+	if !o.Timings {
+		return nil
+	}
+	return NewTimings()
+}
+
+// Nil unless -progress was given.
+func (o *cliOptions) newProgress(workers int) (*Progress, error) {
+	if !o.Progress {
+		return nil, nil
+	}
+	size, err := inputSize(o.Input)
+	if err != nil {
+		return nil, err
+	}
+	return NewProgress(os.Stderr, size, workers), nil
+}
+
+func runCommand(options *cliOptions) error {
+	timings := options.newTimings()
+	result, err := aggregate(options, timings)
+	if err != nil {
+		return err
+	}
+	endPhase := timings.Phase("output")
+	err = result.Write(os.Stdout, options.Format)
+	endPhase()
+	timings.Report(os.Stderr)
+	return err
+}
+
+func validateCommand(options *cliOptions) error {
+	timings := options.newTimings()
+	result, err := aggregate(options, timings)
+	if err != nil {
+		return err
+	}
+	timings.Report(os.Stderr)
+	totals := result.Totals()
+	fmt.Printf("%s: ok, %d rows, %d stations\n", options.Input, totals.Rows, totals.Stations)
+	return nil
+}
+
+func benchCommand(options *cliOptions) error {
+	size, err := inputSize(options.Input)
+	if err != nil {
+		return err
+	}
+	times := make([]time.Duration, 0, options.Runs)
+	var rows int64
+	for run := range options.Runs {
+		timings := options.newTimings()
+		start := time.Now()
+		result, err := aggregate(options, timings)
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		timings.Report(os.Stderr)
+		times = append(times, elapsed)
+		rows = result.Totals().Rows
+		fmt.Printf("run %d: %.3fs\n", run+1, elapsed.Seconds())
+	}
+	slices.Sort(times)
+	var total time.Duration
+	for _, t := range times {
+		total += t
+	}
+	best := times[0].Seconds()
+	fmt.Printf("min %.3fs, median %.3fs, mean %.3fs\n", best, times[len(times)/2].Seconds(), total.Seconds()/float64(len(times)))
+	fmt.Printf("best: %.1f MB/s, %.1fM rows/s\n", float64(size)/best/1e6, float64(rows)/best/1e6)
+	return nil
+}
+
+func statsCommand(options *cliOptions) error {
+	size, err := inputSize(options.Input)
+	if err != nil {
+		return err
+	}
+	timings := options.newTimings()
+	start := time.Now()
+	result, err := aggregate(options, timings)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Seconds()
+	timings.Report(os.Stderr)
+	totals := result.Totals()
+	fmt.Printf("input:      %s\n", options.Input)
+	fmt.Printf("bytes:      %d\n", size)
+	fmt.Printf("rows:       %d\n", totals.Rows)
+	fmt.Printf("stations:   %d\n", totals.Stations)
+	if totals.Buckets > 0 {
+		fmt.Printf("buckets:    %d\n", totals.Buckets)
+	}
+	if totals.Rows > 0 {
+		fmt.Printf("min:        %s\n", result.format(totals.Min))
+		fmt.Printf("max:        %s\n", result.format(totals.Max))
+		fmt.Printf("mean:       %s\n", result.format(totals.Mean))
+	}
+	fmt.Printf("time:       %.3fs\n", elapsed)
+	fmt.Printf("throughput: %.1f MB/s, %.1fM rows/s\n", float64(size)/elapsed/1e6, float64(totals.Rows)/elapsed/1e6)
+	return nil
+}
+
+func inputSize(filename string) (int64, error) {
+	if err := checkInput(filename); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+// Input layout. The default is the challenge format: "name;temp\n", no header, no quotes.
+type Dialect struct {
+	Delimiter []byte
+	// "\n" or "\r\n"
+	LineEnding string
+	// First line is column names, not a record
+	Header bool
+	// Station names may be wrapped in double quotes, with "" for a literal quote.
+	// Quoted names may contain the delimiter but not line breaks.
+	Quoted bool
+
+	// Delimiter's first byte repeated, for SWAR scanning
+	pattern uint64
+	// Single byte delimiter without quoting: the name ends at the first delimiter byte
+	simple bool
+}
+
+func NewDialect(delimiter string, lineEnding string, header bool, quoted bool) (*Dialect, error) {
+	if delimiter == "" {
+		return nil, fmt.Errorf("empty delimiter")
+	}
+	if lineEnding != "\n" && lineEnding != "\r\n" {
+		return nil, fmt.Errorf("unsupported line ending %q", lineEnding)
+	}
+	if bytes.ContainsAny([]byte(delimiter), "\"\r\n.-0123456789") {
+		return nil, fmt.Errorf("delimiter %q clashes with quotes, line endings or numbers", delimiter)
+	}
+	return &Dialect{
+		Delimiter:  []byte(delimiter),
+		LineEnding: lineEnding,
+		Header:     header,
+		Quoted:     quoted,
+		pattern:    uint64(delimiter[0]) * 0x0101010101010101,
+		simple:     len(delimiter) == 1 && !quoted,
+	}, nil
+}
+
+func DefaultDialect() *Dialect {
+	d, _ := NewDialect(";", "\n", false, false)
+	return d
+}
+
+// Strips the header line, if any.
+func (d *Dialect) Body(data []byte) []byte {
+	if !d.Header {
+		return data
+	}
+	if eol := bytes.IndexByte(data, '\n'); eol >= 0 {
+		return data[eol+1:]
+	}
+	return data[len(data):]
+}
+
+// Position of the next delimiter start byte or '\n' at or after pos, or len(data) if
+// neither comes first. Relies on the input padding for the final 8-byte read.
+func (d *Dialect) nextDelimiterByte(data []byte, pos int) int {
+	for ; pos < len(data); pos += 8 {
+		if found := detectDelimiterOrNewline(*(*uint64)(unsafe.Pointer(&data[pos])), d.pattern); found != 0 {
+			return min(pos+bits.TrailingZeros64(found)>>3, len(data))
+		}
+	}
+	return len(data)
+}
+
+// Position of the next full delimiter at or after pos, ignoring quoting, and whether
+// there is one before the end of the line. If not, the position of the line ending or
+// len(data).
+func (d *Dialect) nextDelimiter(data []byte, pos int) (int, bool) {
+	for {
+		pos = d.nextDelimiterByte(data, pos)
+		if pos == len(data) || data[pos] == '\n' {
+			return pos, false
+		}
+		if len(d.Delimiter) == 1 || bytes.HasPrefix(data[pos:], d.Delimiter) {
+			return pos, true
+		}
+		pos++
+	}
+}
+
+// Reads the station name starting at pos, returning it and the position of the
+// delimiter after it. Escaped quotes are unescaped into scratch. Fails for an empty
+// name, an unclosed quote or a line without a delimiter after the name.
+func (d *Dialect) readName(data []byte, pos int, scratch *[]byte) ([]byte, int, error) {
+	if !d.Quoted || data[pos] != '"' {
+		end, ok := d.nextDelimiter(data, pos)
+		if !ok || end == pos {
+			return nil, end, recordError(lineAt(data, pos), d)
+		}
+		return data[pos:end], end, nil
+	}
+	recordStart := pos
+	pos++
+	start := pos
+	end := closingQuote(data, pos)
+	if end < len(data) && data[end] == '"' && (end+1 >= len(data) || data[end+1] != '"') {
+		// No escaped quotes, name can point into the input
+		return d.afterQuote(data, recordStart, data[start:end], end+1)
+	}
+	*scratch = (*scratch)[:0]
+	for {
+		if end == len(data) || data[end] != '"' {
+			return nil, end, fmt.Errorf("unclosed quote in %q", lineAt(data, recordStart))
+		}
+		*scratch = append(*scratch, data[pos:end]...)
+		if end+1 < len(data) && data[end+1] == '"' {
+			*scratch = append(*scratch, '"')
+			pos = end + 2
+			end = closingQuote(data, pos)
+			continue
+		}
+		return d.afterQuote(data, recordStart, *scratch, end+1)
+	}
+}
+
+// Checks what follows a quoted name: the delimiter, at next.
+func (d *Dialect) afterQuote(data []byte, recordStart int, name []byte, next int) ([]byte, int, error) {
+	if !bytes.HasPrefix(data[next:], d.Delimiter) {
+		return nil, next, fmt.Errorf("no delimiter after the quoted station name in %q", lineAt(data, recordStart))
+	}
+	if len(name) == 0 {
+		return nil, next, fmt.Errorf("empty station name in %q", lineAt(data, recordStart))
+	}
+	return name, next, nil
+}
+
+// Position of the next '"' at or after pos, or of the line ending or the end of data if
+// the quote is not closed on this line.
+func closingQuote(data []byte, pos int) int {
+	if i := bytes.IndexAny(data[pos:], "\"\n"); i >= 0 {
+		return pos + i
+	}
+	return len(data)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInputNotFound  = errors.New("not found")
+	ErrNotRegularFile = errors.New("not a regular file")
+)
+
+// The input file could not be used, wrapping ErrInputNotFound, ErrNotRegularFile or
+// the error from the file system.
+type InputError struct {
+	Path string
+	Err  error
+}
+
+func (e *InputError) Error() string {
+	return fmt.Sprintf("input %s: %v", e.Path, e.Err)
+}
+
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+type MmapError struct {
+	Path string
+	Err  error
+}
+
+func (e *MmapError) Error() string {
+	return fmt.Sprintf("could not map %s: %v", e.Path, e.Err)
+}
+
+func (e *MmapError) Unwrap() error {
+	return e.Err
+}
+
+// AllocHugeTLB found no free huge pages, or none are configured.
+type HugePageError struct {
+	Size int
+	Err  error
+}
+
+func (e *HugePageError) Error() string {
+	return fmt.Sprintf("could not allocate %d MiB of huge pages (%v); reserve some with "+
+		"\"sudo sysctl -w vm.nr_hugepages=512\" or run with -alloc=thp", e.Size>>20, e.Err)
+}
+
+func (e *HugePageError) Unwrap() error {
+	return e.Err
+}
+
+// A results table ran out of room for station names, see nameArenaSize.
+type NameArenaFullError struct {
+	Size int
+}
+
+func (e *NameArenaFullError) Error() string {
+	return fmt.Sprintf("more than %d MiB of station names", e.Size>>20)
+}
+
+// A record that does not parse. Offset is the file offset of its first byte; the parse
+// loops report it relative to their chunk and workers add the chunk's offset with
+// inChunk.
+type MalformedInputError struct {
+	Offset int64
+	Err    error
+}
+
+// For the parse loops: the record at pos in their data is malformed.
+func malformedAt(pos int, err error) *MalformedInputError {
+	return &MalformedInputError{Offset: int64(pos), Err: err}
+}
+
+// Moves the offset of a parse loop's error from its chunk to the file, for a chunk at
+// chunkOffset, or from a slice of a chunk to the chunk. Other errors, such as a
+// NameArenaFullError, are returned as they are.
+func inChunk(err error, chunkOffset int64) error {
+	var malformed *MalformedInputError
+	if errors.As(err, &malformed) {
+		return &MalformedInputError{Offset: chunkOffset + malformed.Offset, Err: malformed.Err}
+	}
+	return err
+}
+
+func (e *MalformedInputError) Error() string {
+	return fmt.Sprintf("malformed input at byte %d: %v", e.Offset, e.Err)
+}
+
+func (e *MalformedInputError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+// How station names are turned into IdentityHash.
+type HashMode int
+
+const (
+	// Find the delimiter, then xxhash the name: two passes over the name bytes
+	HashTwoPass HashMode = iota
+	// Hash each word of the name as the delimiter scan reads it
+	HashFused
+)
+
+func ParseHashMode(s string) (HashMode, error) {
+	switch s {
+	case "xxhash":
+		return HashTwoPass, nil
+	case "fused":
+		return HashFused, nil
+	}
+	return 0, fmt.Errorf("unknown hash mode %q, expected xxhash or fused", s)
+}
+
+const (
+	fusedSeed = 0xa0761d6478bd642f
+	fusedMul1 = 0xe7037ed1a0b428db
+	fusedMul2 = 0x8ebc6af09c88c6e3
+)
+
+// Full 64x64->128 multiply folded back to 64 bits, as in wyhash. Every input bit affects
+// every output bit, so a single step per word keeps the collision odds of a 64-bit hash.
+func mum(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+// Scans the name starting at pos, up to the single byte delimiter in pattern, hashing
+// eight bytes at a time. The word holding the delimiter is masked down to the name bytes
+// before it. Like the two pass scan, this reads up to seven bytes past the delimiter.
+// Stops early at a line ending, or returns a position at or past len(data) if there is
+// neither; the hash is meaningless then.
+func scanHashName(data []byte, pos int, pattern uint64) (int, IdentityHash) {
+	start := pos
+	h := uint64(fusedSeed)
+	for pos < len(data) {
+		word := *(*uint64)(unsafe.Pointer(&data[pos]))
+		if found := detectDelimiterOrNewline(word, pattern); found != 0 {
+			nameBytes := bits.TrailingZeros64(found) >> 3
+			word &= 1<<(nameBytes<<3) - 1
+			pos += nameBytes
+			h = mum(h^word, fusedMul1)
+			return pos, IdentityHash(mum(h^uint64(pos-start), fusedMul2))
+		}
+		h = mum(h^word, fusedMul1)
+		pos += 8
+	}
+	return pos, 0
+}
+
+// Same hash as scanHashName, for a name whose end is already known. The last word may
+// read past the name into the rest of the record, like the scan does.
+func fusedHash(name []byte) IdentityHash {
+	p := unsafe.Pointer(unsafe.SliceData(name))
+	h := uint64(fusedSeed)
+	rest := len(name)
+	for ; rest >= 8; rest -= 8 {
+		h = mum(h^*(*uint64)(p), fusedMul1)
+		p = unsafe.Add(p, 8)
+	}
+	word := uint64(0)
+	if rest > 0 {
+		word = *(*uint64)(p) & (1<<(rest<<3) - 1)
+	}
+	h = mum(h^word, fusedMul1)
+	return IdentityHash(mum(h^uint64(len(name)), fusedMul2))
+}
+
+// IterInto with HashFused, for single byte delimiters without quoting.
+func IterFusedInto(data []byte, results *ProcessedResults, known *KnownResults, numberLookup *[65536]decimal1Entry, thresholds *Thresholds, dialect *Dialect) error {
+	pattern := dialect.pattern
+	pos := 0
+	end := len(data)
+	for pos < end {
+		// Read and hash name
+		recordStart := pos
+		var id IdentityHash
+		pos, id = scanHashName(data, pos, pattern)
+		// As in IterInto
+		if pos >= end-1 || data[pos] == '\n' || pos == recordStart {
+			return nameError(data, recordStart, dialect)
+		}
+		name := data[recordStart:pos]
+		pos += 1
+		measurement, next, ok := lookupMeasurement(data, pos, numberLookup)
+		if !ok {
+			var err error
+			if measurement, next, err = ParseDecimal1At(data, pos); err != nil {
+				return malformedAt(recordStart, err)
+			}
+		}
+		var item, newItem *stationEntry
+		if known != nil {
+			item, newItem = known.get(name)
+		}
+		if item == nil && newItem == nil {
+			if item, newItem = results.get(id); newItem != nil {
+				if err := results.setName(newItem, name); err != nil {
+					return err
+				}
+				newItem.Id = id
+			}
+		}
+		addMeasurement(item, newItem, measurement, thresholds)
+		pos = next
+	}
+	return nil
+}
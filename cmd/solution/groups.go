@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Maps station names to the group keys (country, climate zone, ...) they roll up into.
+// File format is one station per line: "name;group[;group...]".
+type GroupMapping map[string][]string
+
+func LoadGroupMapping(filename string) (GroupMapping, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mapping := GroupMapping{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ";")
+		station := fields[0]
+		for _, group := range fields[1:] {
+			if group != "" {
+				mapping[station] = append(mapping[station], group)
+			}
+		}
+	}
+	return mapping, scanner.Err()
+}
+
+// Aggregates station results per group. Runs after the main pass so the parse loop is
+// untouched; stations without a mapping are left out. Groups are returned sorted by name.
+func (m GroupMapping) Rollup(stats *ProcessedResults) []*WeatherStationData {
+	groups := map[string]*WeatherStationData{}
+	for item := range stats.Entries() {
+		for _, key := range m[item.Name] {
+			if group, ok := groups[key]; ok {
+				group.Merge(item)
+			} else {
+				group := *item
+				group.Name = key
+				groups[key] = &group
+			}
+		}
+	}
+	result := make([]*WeatherStationData, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, group)
+	}
+	slices.SortFunc(result, func(a, b *WeatherStationData) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return result
+}
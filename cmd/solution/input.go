@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"os"
+)
+
+// Where workers get their newline-aligned chunks of records from, each with its offset
+// in the file for error messages. home is the worker's preferred region, see
+// ScheduleOptions.homeRegion.
+type ChunkSource interface {
+	Chunks(home int) iter.Seq2[int64, []byte]
+}
+
+type ReadMode int
+
+const (
+	// mmap with MAP_POPULATE, split by the chunk scheduler
+	ReadMmap ReadMode = iota
+	// Sequential preads into a ring of buffers
+	ReadPread
+	// Like ReadPread, with O_DIRECT
+	ReadDirect
+	// Many concurrent fixed-buffer reads through io_uring
+	ReadUring
+)
+
+func ParseReadMode(s string) (ReadMode, error) {
+	switch s {
+	case "mmap":
+		return ReadMmap, nil
+	case "pread":
+		return ReadPread, nil
+	case "direct":
+		return ReadDirect, nil
+	case "uring":
+		return ReadUring, nil
+	}
+	return 0, fmt.Errorf("unknown read mode %q, expected mmap, pread, direct or uring", s)
+}
+
+type ReadOptions struct {
+	Mode ReadMode
+	// Block size and number of buffers for the streaming modes
+	BlockSize int
+	Buffers   int
+}
+
+func DefaultReadOptions(schedule *ScheduleOptions) ReadOptions {
+	return ReadOptions{Mode: ReadMmap, BlockSize: 8 << 20, Buffers: 2*schedule.Workers + 2}
+}
+
+type Input struct {
+	Source ChunkSource
+	// The first records, for format detection
+	Sample []byte
+	// File offset of Sample, past any header
+	SampleOffset int64
+
+	scheduler *ChunkScheduler
+	fileMap   *MmapFile
+	stream    streamingReader
+}
+
+type streamingReader interface {
+	ChunkSource
+	Err() error
+	Close() error
+}
+
+// Zero bytes after a mapped input for the parsers to read past the last record. The
+// word-at-a-time name scans load eight bytes from anywhere up to the delimiter, so a
+// last record as short as "a;5", or one without a line ending, is read up to 7 bytes
+// past its end.
+const mmapPadSize = 7
+
+func OpenInput(filename string, options *ReadOptions, dialect *Dialect, schedule *ScheduleOptions) (*Input, error) {
+	if err := checkInput(filename); err != nil {
+		return nil, err
+	}
+	if options.Mode == ReadMmap {
+		// NUMA aware runs leave page faults to the workers, so each node caches its own region.
+		fileMap, err := NewMmapFile(filename, mmapPadSize, len(schedule.Nodes) == 0)
+		if err != nil {
+			return nil, &MmapError{Path: filename, Err: err}
+		}
+		data := dialect.Body(fileMap.Data)
+		offset := int64(len(fileMap.Data) - len(data))
+		scheduler := schedule.NewScheduler(data, offset)
+		return &Input{Source: scheduler, Sample: data, SampleOffset: offset, scheduler: scheduler, fileMap: fileMap}, nil
+	}
+
+	sample, err := readSample(filename, detectSampleSize)
+	if err != nil {
+		return nil, err
+	}
+	var stream streamingReader
+	if options.Mode == ReadUring {
+		stream, err = NewUringReader(filename, options.BlockSize, options.Buffers, dialect.Header)
+	} else {
+		stream, err = NewStreamReader(filename, options.BlockSize, options.Buffers, options.Mode == ReadDirect, dialect.Header)
+	}
+	if err != nil {
+		return nil, err
+	}
+	body := dialect.Body(sample)
+	return &Input{Source: stream, Sample: body, SampleOffset: int64(len(sample) - len(body)), stream: stream}, nil
+}
+
+// Rejects what no read mode can handle, with errors that say why.
+func checkInput(filename string) error {
+	fi, err := os.Stat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &InputError{Path: filename, Err: ErrInputNotFound}
+	}
+	if err != nil {
+		return &InputError{Path: filename, Err: err}
+	}
+	if !fi.Mode().IsRegular() {
+		return &InputError{Path: filename, Err: ErrNotRegularFile}
+	}
+	return nil
+}
+
+func readSample(filename string, size int) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sample := make([]byte, size)
+	n, err := io.ReadFull(f, sample)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return sample[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Drop the partial record at the end
+	return sample[:bytes.LastIndexByte(sample, '\n')+1], nil
+}
+
+// Error that cut reading short, once all chunks have been consumed.
+func (i *Input) Err() error {
+	if i.stream != nil {
+		return i.stream.Err()
+	}
+	return nil
+}
+
+func (i *Input) ReportNUMAPlacement(schedule *ScheduleOptions) {
+	if i.scheduler == nil {
+		fmt.Fprintln(os.Stderr, "NUMA placement of input regions only applies to mmap reads")
+		return
+	}
+	ReportNUMAPlacement(schedule, i.scheduler)
+}
+
+func (i *Input) Close() error {
+	if i.stream != nil {
+		return i.stream.Close()
+	}
+	return i.fileMap.Close()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// Records filling exactly pages pages, ending in a record for a name of nameLen bytes
+// read as measurement, with or without a final line ending. With mmap such a file has
+// no slack in its last page, so reading past the end of it is a SIGBUS unless
+// NewMmapFile maps padding behind it.
+func pageAlignedInput(rng *rand.Rand, stations []string, pages, nameLen int, measurement string, terminated bool) ([]byte, map[string]WeatherStationData) {
+	var data bytes.Buffer
+	want := map[string]WeatherStationData{}
+	last := strings.Repeat("t", nameLen) + ";" + measurement
+	if terminated {
+		last += "\n"
+	}
+	target := pages*os.Getpagesize() - len(last)
+	for target-data.Len() > 64 {
+		name := stations[rng.IntN(len(stations))]
+		measurement := testMeasurement(rng)
+		fmt.Fprintf(&data, "%s;%s\n", name, measurement)
+		addReading(want, name, measurement)
+	}
+	// One record of whatever length is left, then the last one
+	filler := strings.Repeat("f", target-data.Len()-len(";0.0\n"))
+	fmt.Fprintf(&data, "%s;0.0\n%s", filler, last)
+	addReading(want, filler, "0.0")
+	addReading(want, strings.Repeat("t", nameLen), measurement)
+	return data.Bytes(), want
+}
+
+// Opens path like OpenInput, and for mmap reads makes sure a page that faults on any
+// access follows the mapping, so that reading further than the padding crashes instead
+// of landing in whatever the process mapped there. New mappings normally go right below
+// the previous one, so the guard is mapped first and the input retried until it fits.
+func openGuarded(t *testing.T, path string, options *ReadOptions, dialect *Dialect, schedule *ScheduleOptions) (*Input, error) {
+	if options.Mode != ReadMmap {
+		return OpenInput(path, options, dialect, schedule)
+	}
+	// Guards that did not end up after the input stay mapped until the end, so that the
+	// next attempt does not fall into the same hole
+	var missed [][]byte
+	defer func() {
+		for _, guard := range missed {
+			syscall.Munmap(guard)
+		}
+	}()
+	for range 10 {
+		guard, err := syscall.Mmap(-1, 0, os.Getpagesize(), syscall.PROT_NONE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input, err := OpenInput(path, options, dialect, schedule)
+		if err != nil {
+			syscall.Munmap(guard)
+			return nil, err
+		}
+		mapping := input.fileMap.mapping
+		if unsafe.Add(unsafe.Pointer(unsafe.SliceData(mapping)), len(mapping)) == unsafe.Pointer(&guard[0]) {
+			t.Cleanup(func() { syscall.Munmap(guard) })
+			return input, nil
+		}
+		input.Close()
+		missed = append(missed, guard)
+	}
+	t.Fatal("could not map a guard page after the input")
+	return nil, nil
+}
+
+// Opens path the given way and runs iter over every chunk into one table.
+func parseFile(t *testing.T, iter iterFunc, path string, options *ReadOptions, dialect *Dialect) map[string]WeatherStationData {
+	schedule := ScheduleOptions{Workers: 1, ChunkSize: 1000}
+	input, err := openGuarded(t, path, options, dialect, &schedule)
+	if err != nil {
+		skipUnsupported(t, options, err)
+		t.Fatal(err)
+	}
+	defer input.Close()
+	stations, err := parseChunks(t, iter, input, dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stations
+}
+
+func skipUnsupported(t *testing.T, options *ReadOptions, err error) {
+	if options.Mode == ReadUring {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+}
+
+// Runs iter over every chunk of input into one table, placing errors in the file like
+// process does.
+func parseChunks(t *testing.T, iter iterFunc, input *Input, dialect *Dialect) (map[string]WeatherStationData, error) {
+	results := newTestResults(t)
+	defer results.Close()
+	lookup := PrepareDecimal1Lookup(dialect.LineEnding)
+	thresholds := NoThresholds()
+	for offset, chunk := range input.Source.Chunks(0) {
+		if err := iter(chunk, results, nil, &lookup, &thresholds, dialect); err != nil {
+			return nil, inChunk(err, offset)
+		}
+	}
+	if err := input.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return stationsOf(results), nil
+}
+
+// Files of a whole number of pages, whose last record ends at each offset within a
+// word right at the end of the file, through every read mode and parser. Blocks and
+// chunks are smaller than a page, so records are also split between reads.
+func TestPageAlignedInputs(t *testing.T) {
+	modes := []struct {
+		name    string
+		options ReadOptions
+	}{
+		{"mmap", ReadOptions{Mode: ReadMmap}},
+		{"pread", ReadOptions{Mode: ReadPread, BlockSize: 1000, Buffers: 4}},
+		{"uring", ReadOptions{Mode: ReadUring, BlockSize: 1000, Buffers: 4}},
+	}
+	parsers := append([]testParser{{"xxhash", IterInto}}, fastParsers(t)...)
+	dialect, err := NewDialect(";", "\n", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewPCG(3, 4))
+	stations := testStations(rng, 60)
+	dir := t.TempDir()
+	for pages := 1; pages <= 3; pages++ {
+		for nameLen := 1; nameLen <= 8; nameLen++ {
+			for _, terminated := range []bool{true, false} {
+				measurement := testMeasurement(rng)
+				data, want := pageAlignedInput(rng, stations, pages, nameLen, measurement, terminated)
+				path := filepath.Join(dir, fmt.Sprintf("%d-%d-%t.txt", pages, nameLen, terminated))
+				if err := os.WriteFile(path, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				name := fmt.Sprintf("%d pages/last %q/terminated %t", pages, data[len(data)-12:], terminated)
+				t.Run(name, func(t *testing.T) {
+					for _, mode := range modes {
+						for _, p := range parsers {
+							t.Run(mode.name+"/"+p.name, func(t *testing.T) {
+								compareStations(t, parseFile(t, p.iter, path, &mode.options, dialect), want)
+							})
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// Records the parsers cannot take apart, after the sample that format detection checks,
+// so only the parse loops see them. Each is the last record of a chunk and block, in the
+// middle of one, or the end of the file, and every read mode and parser has to report
+// where it starts rather than crash or read it as part of the next line.
+func TestMalformedRecordsPastSample(t *testing.T) {
+	records := []struct {
+		name, record string
+	}{
+		{"no delimiter", "abc\n"},
+		{"unterminated without delimiter", "abc"},
+		{"blank line", "\n"},
+		{"empty name", ";1.0\n"},
+		{"no measurement", "abc;\n"},
+		{"unterminated without measurement", "abc;"},
+		{"bad measurement", "abc;1x\n"},
+		{"letter for the point", "abc;1n2\n"},
+		{"letter for the point in a long measurement", "abc;12n3\n"},
+	}
+	const chunkSize = 4096
+	modes := []struct {
+		name    string
+		options ReadOptions
+	}{
+		{"mmap", ReadOptions{Mode: ReadMmap}},
+		{"pread", ReadOptions{Mode: ReadPread, BlockSize: chunkSize, Buffers: 4}},
+		{"uring", ReadOptions{Mode: ReadUring, BlockSize: chunkSize, Buffers: 4}},
+	}
+	parsers := append([]testParser{{"xxhash", IterInto}}, fastParsers(t)...)
+	dialect, err := NewDialect(";", "\n", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewPCG(5, 6))
+	stations := testStations(rng, 60)
+	var valid bytes.Buffer
+	for valid.Len() < detectSampleSize+8*chunkSize {
+		fmt.Fprintf(&valid, "%s;%s\n", stations[rng.IntN(len(stations))], testMeasurement(rng))
+	}
+	dir := t.TempDir()
+	for _, r := range records {
+		placements := []struct {
+			name string
+			// Valid records before and after the bad one
+			before, after []byte
+		}{
+			{"end of file", valid.Bytes(), nil},
+		}
+		if strings.HasSuffix(r.record, "\n") {
+			// A filler record so that the bad one ends right at a chunk boundary
+			head := valid.Bytes()[:bytes.IndexByte(valid.Bytes()[detectSampleSize:], '\n')+detectSampleSize+1]
+			boundary := (len(head)+len(r.record)+64)/chunkSize*chunkSize + chunkSize
+			filler := strings.Repeat("f", boundary-len(head)-len(r.record)-len(";0.0\n"))
+			atBoundary := append(append([]byte{}, head...), filler+";0.0\n"...)
+			placements = append(placements,
+				struct {
+					name          string
+					before, after []byte
+				}{"end of chunk", atBoundary, valid.Bytes()[len(head):]},
+				struct {
+					name          string
+					before, after []byte
+				}{"middle of chunk", append(atBoundary, "x;1.0\n"...), valid.Bytes()[len(head):]})
+		}
+		for _, placement := range placements {
+			data := append(append(append([]byte{}, placement.before...), r.record...), placement.after...)
+			path := filepath.Join(dir, "input.txt")
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			for _, mode := range modes {
+				for _, p := range parsers {
+					t.Run(r.name+"/"+placement.name+"/"+mode.name+"/"+p.name, func(t *testing.T) {
+						schedule := ScheduleOptions{Workers: 1, ChunkSize: chunkSize}
+						input, err := OpenInput(path, &mode.options, dialect, &schedule)
+						if err != nil {
+							skipUnsupported(t, &mode.options, err)
+							t.Fatal(err)
+						}
+						defer input.Close()
+						_, err = parseChunks(t, p.iter, input, dialect)
+						var malformed *MalformedInputError
+						if !errors.As(err, &malformed) {
+							t.Fatalf("got %v, want a MalformedInputError", err)
+						}
+						if want := int64(len(placement.before)); malformed.Offset != want {
+							t.Errorf("got offset %d, want %d: %v", malformed.Offset, want, err)
+						}
+					})
+				}
+			}
+		}
+	}
+}
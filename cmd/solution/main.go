@@ -1,97 +1,477 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"runtime"
 	"runtime/debug"
-	"runtime/pprof"
+	"strconv"
 )
 
 func main() {
 	debug.SetGCPercent(-1)
 	debug.SetMemoryLimit(math.MaxInt64)
-	if os.Getenv("PROFILE") != "" {
-		profFileName := os.Args[0] + ".prof"
-		fmt.Fprintln(os.Stderr, "### Profiling enabled")
-		pfile, err := os.Create(profFileName)
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// One complete pass over the input, configured by the environment with the command
+// line's overrides on top. timings may be nil.
+func aggregate(options *cliOptions, timings *Timings) (*Aggregate, error) {
+	fmt.Fprintln(os.Stderr, "Reading records from", options.Input)
+
+	schedule, err := scheduleFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if options.Workers > 0 {
+		schedule.Workers = options.Workers
+	}
+	if options.Alloc != "" {
+		if schedule.Alloc, err = ParseAllocMode(options.Alloc); err != nil {
+			return nil, err
+		}
+	}
+	if len(schedule.CPUs) > 0 {
+		fmt.Fprintln(os.Stderr, "Pinning", schedule.Workers, "workers to CPUs", schedule.CPUs)
+	}
+
+	dialect, err := dialectFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	readOptions, err := readOptionsFromEnv(&schedule)
+	if err != nil {
+		return nil, err
+	}
+	endPhase := timings.Phase("open input")
+	input, err := OpenInput(options.Input, &readOptions, dialect, &schedule)
+	endPhase()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		endPhase := timings.Phase("close input")
+		input.Close()
+		endPhase()
+	}()
+	if len(schedule.Nodes) > 0 {
+		defer input.ReportNUMAPlacement(&schedule)
+	}
+	progress, err := options.newProgress(schedule.Workers)
+	if err != nil {
+		return nil, err
+	}
+	// Stopped once parsing is done so reports do not land in the middle of its line,
+	// and aborted here on errors
+	defer progress.Abort()
+	source := progress.Source(input.Source)
+
+	var groups GroupMapping
+	if groupsFile := os.Getenv("GROUPS_FILE"); groupsFile != "" {
+		groups, err = LoadGroupMapping(groupsFile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		defer pfile.Close()
-		pprof.StartCPUProfile(pfile)
-		defer func() {
-			pprof.StopCPUProfile()
-			fmt.Fprintln(os.Stderr, "### Profiling done, run:\ngo tool pprof", os.Args[0], profFileName)
-		}()
 	}
 
-	inputFile := "measurements.txt"
-	if len(os.Args) > 1 {
-		inputFile = os.Args[1]
+	result := &Aggregate{Digits: 1}
+
+	// TIME_WINDOW switches to the "name;timestamp;temp" dialect, aggregated per time bucket
+	if windowName := os.Getenv("TIME_WINDOW"); windowName != "" {
+		window, err := ParseTimeWindow(windowName)
+		if err != nil {
+			return nil, err
+		}
+		if groups != nil {
+			return nil, errors.New("GROUPS_FILE is not supported with TIME_WINDOW")
+		}
+		thresholds, withThresholds, err := thresholdsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		result.Thresholds = withThresholds
+		stats, err := processTimedParallel(source, &thresholds, dialect, window, &schedule, timings)
+		if err != nil {
+			return nil, err
+		}
+		if err := input.Err(); err != nil {
+			return nil, err
+		}
+		progress.Stop()
+		endPhase := timings.Phase("collect results")
+		for _, entry := range stats.Sorted() {
+			result.Stations = append(result.Stations, decimal1Row(entry.WeatherStationData, window.Format(entry.Bucket)))
+		}
+		endPhase()
+		return result, nil
 	}
-	fmt.Fprintln(os.Stderr, "Reading records from", inputFile)
 
-	// Add a few bytes of padding so we can read past end of file for some calculations
-	fileMap, err := NewMmapFile(inputFile, 3)
+	endPhase = timings.Phase("detect format")
+	format, fitsLookup, err := numberFormatFromEnv(input.Sample, input.SampleOffset, dialect)
+	endPhase()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if !fitsLookup {
+		if groups != nil {
+			return nil, fmt.Errorf("GROUPS_FILE is not supported by the wide number parser, needed for %d decimals, range %g", format.Digits, format.Range)
+		}
+		fmt.Fprintf(os.Stderr, "Using wide number parser: %d decimals, range %g\n", format.Digits, format.Range)
+		wideThresholds, withThresholds, err := wideThresholdsFromEnv(format)
+		if err != nil {
+			return nil, err
+		}
+		result.Thresholds = withThresholds
+		stats, err := processWideParallel(source, format, &wideThresholds, dialect, &schedule, timings)
+		if err != nil {
+			return nil, err
+		}
+		if err := input.Err(); err != nil {
+			return nil, err
+		}
+		progress.Stop()
+		endPhase := timings.Phase("collect results")
+		result.Digits = format.Digits
+		for _, item := range stats.Sorted() {
+			result.Stations = append(result.Stations, wideRow(item, format))
+		}
+		endPhase()
+		return result, nil
+	}
+
+	// Only now that the values are known to fit Decimal1_16, as wide data may have
+	// thresholds beyond it
+	thresholds, withThresholds, err := thresholdsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	result.Thresholds = withThresholds
+
+	parse := ParseOptions{}
+	if stationsFile := os.Getenv("STATIONS_FILE"); stationsFile != "" {
+		endPhase := timings.Phase("station hash")
+		names, err := LoadStationList(stationsFile)
+		if err != nil {
+			return nil, err
+		}
+		// Every station still gets counted through the general table, only slower
+		if parse.Stations, err = NewPerfectHash(names); err != nil {
+			fmt.Fprintln(os.Stderr, "Not using perfect hashing:", err)
+		}
+		endPhase()
+	}
+
+	if parse.Hash, parse.Scan, err = hashAndScanFromEnv(dialect); err != nil {
+		return nil, err
 	}
-	defer fileMap.Close()
 
-	stats := processParallel(fileMap.Data)
+	var counters *Counters
+	if options.Counters {
+		counters = NewCounters(schedule.Workers)
+	}
+	stats, tables, err := processParallel(source, &parse, &thresholds, dialect, &schedule, timings, counters)
+	defer tables.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := input.Err(); err != nil {
+		return nil, err
+	}
+	progress.Stop()
+	counters.Report(os.Stderr)
+	endPhase = timings.Phase("collect results")
+	defer endPhase()
 	for item := range stats.Entries() {
-		mMax := Decimal1_16ToFloat(item.Max)
-		mMin := Decimal1_16ToFloat(item.Min)
-		mAvg := Decimal1_64ToFloat(item.Sum) / float64(item.Count)
-		fmt.Printf("%s;%0.1f;%0.1f;%0.1f\n", item.Name, mMax, mMin, mAvg)
+		result.Stations = append(result.Stations, decimal1Row(item, ""))
 	}
+	if groups != nil {
+		result.Groups = []ResultRow{}
+		for _, group := range groups.Rollup(stats) {
+			result.Groups = append(result.Groups, decimal1Row(group, ""))
+		}
+	}
+	return result, nil
 }
 
-func processParallel(data []byte) *ProcessedResults {
-	lookup := PrepareDecimal1Lookup()
-	partitions := partitionData(data, runtime.NumCPU())
-	resultsCh := make(chan *ProcessedResults)
-	for _, partition := range partitions {
-		go process(partition, resultsCh, &lookup)
+// WORKERS and CHUNK_SIZE tune the chunk scheduler. CHUNK_SIZE is in bytes, with an
+// optional K, M or G suffix.
+// PIN=1 pins each worker thread to one of the allowed CPUs, CPUS=0-3,8 to the listed
+// ones, and SKIP_SMT=1 leaves out all but one hardware thread per core. NUMA=1 pins too,
+// with CPUs interleaved across nodes and per-node input regions and result tables.
+// When pinning, WORKERS defaults to one per CPU used. ALLOC picks where the workers'
+// result tables are allocated.
+func scheduleFromEnv() (ScheduleOptions, error) {
+	schedule := DefaultScheduleOptions()
+	var err error
+	if s := os.Getenv("CPUS"); s != "" {
+		if schedule.CPUs, err = ParseCPUList(s); err != nil {
+			return schedule, err
+		}
+	} else if os.Getenv("PIN") != "" || os.Getenv("SKIP_SMT") != "" {
+		if schedule.CPUs, err = AllowedCPUs(); err != nil {
+			return schedule, err
+		}
 	}
-	stats, err := Alloc[ProcessedResults](ProcessedResultsSize)
-	if err != nil {
-		panic(err)
+	if os.Getenv("SKIP_SMT") != "" {
+		if schedule.CPUs, err = WithoutSMTSiblings(schedule.CPUs); err != nil {
+			return schedule, err
+		}
 	}
-	for range partitions {
-		stats.MergeFrom(<-resultsCh)
+	if os.Getenv("NUMA") != "" {
+		nodes, err := NumaTopology()
+		if err != nil {
+			return schedule, err
+		}
+		if err := schedule.UseNUMA(nodes); err != nil {
+			return schedule, err
+		}
+	}
+	if len(schedule.CPUs) > 0 {
+		schedule.Workers = len(schedule.CPUs)
 	}
-	return stats
+	if s := os.Getenv("WORKERS"); s != "" {
+		workers, err := strconv.Atoi(s)
+		if err != nil || workers < 1 {
+			return schedule, fmt.Errorf("invalid WORKERS %q", s)
+		}
+		schedule.Workers = workers
+	}
+	if s := os.Getenv("ALLOC"); s != "" {
+		if schedule.Alloc, err = ParseAllocMode(s); err != nil {
+			return schedule, err
+		}
+	}
+	if s := os.Getenv("CHUNK_SIZE"); s != "" {
+		size, err := ParseSize(s)
+		if err != nil || size < 1 {
+			return schedule, fmt.Errorf("invalid CHUNK_SIZE %q", s)
+		}
+		schedule.ChunkSize = size
+	}
+	return schedule, nil
+}
+
+// READ_MODE=pread or direct streams the input through READ_BUFFERS buffers of
+// READ_BLOCK bytes instead of mapping it, so parsing overlaps with cold cache reads.
+func readOptionsFromEnv(schedule *ScheduleOptions) (ReadOptions, error) {
+	options := DefaultReadOptions(schedule)
+	var err error
+	if s := os.Getenv("READ_MODE"); s != "" {
+		if options.Mode, err = ParseReadMode(s); err != nil {
+			return options, err
+		}
+	}
+	if s := os.Getenv("READ_BLOCK"); s != "" {
+		if options.BlockSize, err = ParseSize(s); err != nil || options.BlockSize < 1 {
+			return options, fmt.Errorf("invalid READ_BLOCK %q", s)
+		}
+	}
+	if s := os.Getenv("READ_BUFFERS"); s != "" {
+		if options.Buffers, err = strconv.Atoi(s); err != nil || options.Buffers < 1 {
+			return options, fmt.Errorf("invalid READ_BUFFERS %q", s)
+		}
+	}
+	return options, nil
+}
+
+// DELIMITER, LINE_ENDING, HEADER and QUOTED describe CSV style exports. DELIMITER
+// understands "tab" as a convenience, LINE_ENDING is "lf" or "crlf".
+func dialectFromEnv() (*Dialect, error) {
+	delimiter := os.Getenv("DELIMITER")
+	switch delimiter {
+	case "":
+		delimiter = ";"
+	case "tab":
+		delimiter = "\t"
+	}
+	lineEnding := "\n"
+	switch os.Getenv("LINE_ENDING") {
+	case "", "lf":
+	case "crlf":
+		lineEnding = "\r\n"
+	default:
+		return nil, fmt.Errorf("invalid LINE_ENDING %q, expected lf or crlf", os.Getenv("LINE_ENDING"))
+	}
+	return NewDialect(delimiter, lineEnding, os.Getenv("HEADER") != "", os.Getenv("QUOTED") != "")
+}
+
+// HASH=fused hashes names during the delimiter scan instead of after it, see
+// ./bench-hash.sh. SCAN=avx2, avx512 or neon finds delimiters and line ends with SIMD
+// kernels. Only single byte delimiters without quoting can be scanned either way.
+func hashAndScanFromEnv(dialect *Dialect) (HashMode, ScanMode, error) {
+	hash, scan := HashTwoPass, ScanSWAR
+	var err error
+	if s := os.Getenv("HASH"); s != "" {
+		if hash, err = ParseHashMode(s); err != nil {
+			return hash, scan, err
+		}
+		if hash == HashFused && !dialect.simple {
+			return hash, scan, fmt.Errorf("HASH=fused needs a single byte delimiter without quoting")
+		}
+	}
+	if s := os.Getenv("SCAN"); s != "" {
+		if scan, err = ParseScanMode(s); err != nil {
+			return hash, scan, err
+		}
+		if scan != ScanSWAR && !dialect.simple {
+			return hash, scan, fmt.Errorf("SCAN=%s needs a single byte delimiter without quoting", s)
+		}
+	}
+	return hash, scan, nil
+}
+
+// PRECISION and VALUE_RANGE describe measurements that do not fit the one decimal
+// lookup. Without them the format is detected from the start of the input.
+func numberFormatFromEnv(data []byte, offset int64, dialect *Dialect) (NumberFormat, bool, error) {
+	precision, valueRange := os.Getenv("PRECISION"), os.Getenv("VALUE_RANGE")
+	if precision == "" && valueRange == "" {
+		format, fitsLookup, err := DetectNumberFormat(data, dialect)
+		if err != nil {
+			return format, false, inChunk(err, offset)
+		}
+		return format, fitsLookup, nil
+	}
+	format := NumberFormat{Digits: 1, Range: math.Inf(1)}
+	if precision != "" {
+		digits, err := strconv.Atoi(precision)
+		if err != nil || digits < 0 || digits > 18 {
+			return format, false, fmt.Errorf("invalid PRECISION %q", precision)
+		}
+		format.Digits = digits
+	}
+	if valueRange != "" {
+		r, err := strconv.ParseFloat(valueRange, 64)
+		if err != nil || r < 0 {
+			return format, false, fmt.Errorf("invalid VALUE_RANGE %q", valueRange)
+		}
+		format.Range = r
+	}
+	return format, format.FitsDecimal1Lookup(), nil
+}
+
+// thresholdsFromEnv for the wide parser, in units of format.
+func wideThresholdsFromEnv(format NumberFormat) (WideThresholds, bool, error) {
+	thresholds := NoWideThresholds()
+	enabled := false
+	var err error
+	if s := os.Getenv("HEAT_THRESHOLD"); s != "" {
+		if thresholds.Heat, err = format.ParseThreshold(s); err != nil {
+			return thresholds, false, err
+		}
+		enabled = true
+	}
+	if s := os.Getenv("FROST_THRESHOLD"); s != "" {
+		if thresholds.Frost, err = format.ParseThreshold(s); err != nil {
+			return thresholds, false, err
+		}
+		enabled = true
+	}
+	return thresholds, enabled, nil
 }
 
-func partitionData(data []byte, numPartitions int) [][]byte {
-	partitions := make([][]byte, numPartitions)
-	partitionSize := len(data) / numPartitions
-	prevEnd := 0
-	for i := range numPartitions {
-		start := prevEnd
-		end := max(start, partitionSize*(i+1))
-		if i == numPartitions-1 {
-			end = len(data)
-		} else {
-			for data[end-1] != byte('\n') && end < len(data) {
-				end += 1
-			}
-		}
-		prevEnd = end
-		partitions[i] = data[start:end]
-	}
-	return partitions
+// HEAT_THRESHOLD and FROST_THRESHOLD enable per-station counts of readings above
+// and below the given temperatures.
+func thresholdsFromEnv() (Thresholds, bool, error) {
+	thresholds := NoThresholds()
+	enabled := false
+	var err error
+	if s := os.Getenv("HEAT_THRESHOLD"); s != "" {
+		if thresholds.Heat, err = ParseDecimal1(s); err != nil {
+			return thresholds, false, err
+		}
+		enabled = true
+	}
+	if s := os.Getenv("FROST_THRESHOLD"); s != "" {
+		if thresholds.Frost, err = ParseDecimal1(s); err != nil {
+			return thresholds, false, err
+		}
+		enabled = true
+	}
+	return thresholds, enabled, nil
 }
 
-func process(data []byte, resultCh chan *ProcessedResults, lookup *[65536]Decimal1_16) {
-	results, err := Alloc[ProcessedResults](ProcessedResultsSize)
+// counters may be nil, like timings. Also returns every worker's table, the merged one
+// among them, for the caller to close once it is done with the result, failed or not.
+func processParallel(source ChunkSource, parse *ParseOptions, thresholds *Thresholds, dialect *Dialect, schedule *ScheduleOptions, timings *Timings, counters *Counters) (*ProcessedResults, workerTables, error) {
+	endPhase := timings.Phase("lookup table")
+	lookup := PrepareDecimal1Lookup(dialect.LineEnding)
+	endPhase()
+	resultsCh := make(chan *ProcessedResults, schedule.Workers)
+	tables := make(workerTables, schedule.Workers)
+	group := newWorkerGroup()
+	timings.StartWorkers(schedule.Workers)
+	for worker := range schedule.Workers {
+		group.Go(func() error {
+			return process(worker, schedule, source, resultsCh, &tables[worker], group, timings.Worker(worker), counters.Worker(worker), parse, &lookup, thresholds, dialect)
+		})
+	}
+	stats, err := MergeAsFinished(resultsCh, schedule.Workers, group)
+	timings.WorkersDone()
+	if err == nil {
+		// Merging only waits for the results, not for the workers to return
+		err = group.Wait()
+	}
+	return stats, tables, err
+}
+
+// Worker result tables, nil where allocation failed or never happened.
+type workerTables []*ProcessedResults
+
+func (t workerTables) Close() {
+	for _, table := range t {
+		if table != nil {
+			table.Close()
+		}
+	}
+}
+
+// Stores the table in *table as soon as it exists, so that it is closed even if this fails.
+func process(worker int, schedule *ScheduleOptions, source ChunkSource, resultCh chan *ProcessedResults, table **ProcessedResults, group *workerGroup, timing *WorkerTiming, counting *WorkerCounters, parse *ParseOptions, lookup *[65536]decimal1Entry, thresholds *Thresholds, dialect *Dialect) error {
+	if err := schedule.pinWorker(worker); err != nil {
+		return err
+	}
+	endAlloc := timing.StartAlloc()
+	results, mapping, err := AllocOnNode[ProcessedResults](ProcessedResultsSize, schedule.workerNode(worker), schedule.Alloc)
 	if err != nil {
-		fmt.Fprint(os.Stderr, "Could not allocate huge pages. Try:\nsudo sysctl -w vm.nr_hugepages=512\n")
-		panic(err)
+		return err
+	}
+	results.mapping = mapping
+	*table = results
+	if err := results.names.init(schedule.workerNode(worker)); err != nil {
+		return err
+	}
+	var known *KnownResults
+	if parse.Stations != nil {
+		known = parse.Stations.NewResults()
+	}
+	endAlloc()
+	iter := parse.Iter()
+	if counting != nil {
+		// Counters follow the thread, so keep the worker on it
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		counting.Start()
+		defer counting.Close()
+	}
+	endParse := timing.StartParse()
+	for offset, chunk := range source.Chunks(schedule.homeRegion(worker)) {
+		if group.Failed() {
+			return nil
+		}
+		timing.Chunk(len(chunk))
+		if err := iter(chunk, results, known, lookup, thresholds, dialect); err != nil {
+			return inChunk(err, offset)
+		}
+	}
+	if known != nil {
+		if err := known.FlushInto(results); err != nil {
+			return err
+		}
 	}
-	IterInto(data, results, lookup)
+	endParse(results.Rows)
+	counting.Stop(results.Rows())
 	resultCh <- results
+	return nil
 }
@@ -0,0 +1,82 @@
+package main
+
+import "sync"
+
+// Runs workers like errgroup.Group: Wait returns the first error, and failed is closed
+// as soon as there is one, so the other workers can stop at their next chunk.
+type workerGroup struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+	failed chan struct{}
+}
+
+func newWorkerGroup() *workerGroup {
+	return &workerGroup{failed: make(chan struct{})}
+}
+
+func (g *workerGroup) Go(f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				close(g.failed)
+			})
+		}
+	}()
+}
+
+func (g *workerGroup) Failed() bool {
+	select {
+	case <-g.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *workerGroup) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
+
+// Combines count worker results arriving on resultsCh, pairing them up as they finish.
+// Each pair is merged on its own goroutine and the result sent back on resultsCh, so
+// merging overlaps with workers still parsing and forms a tree of depth log2(count)
+// instead of count serial merges on one goroutine. resultsCh needs room for count
+// results. Merges run in group too, so when a worker or merge fails, this returns its
+// error once all of them are done and no table is still in use.
+func MergeAsFinished[R interface{ MergeFrom(R) error }](resultsCh chan R, count int, group *workerGroup) (R, error) {
+	var waiting R
+	haveWaiting := false
+	// Tables still to be combined, including ones being merged
+	tables := count
+	for {
+		var results R
+		select {
+		case results = <-resultsCh:
+		case <-group.failed:
+			var none R
+			return none, group.Wait()
+		}
+		if tables == 1 {
+			return results, nil
+		}
+		if !haveWaiting {
+			waiting, haveWaiting = results, true
+			continue
+		}
+		into := waiting
+		haveWaiting = false
+		tables--
+		group.Go(func() error {
+			if err := into.MergeFrom(results); err != nil {
+				return err
+			}
+			resultsCh <- into
+			return nil
+		})
+	}
+}
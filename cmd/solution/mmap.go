@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"runtime"
 	"syscall"
@@ -9,45 +10,90 @@ import (
 
 type MmapFile struct {
 	Data []byte
+	// Data followed by the zero padding
+	mapping []byte
 }
 
 func (m *MmapFile) Close() error {
-	data := m.Data
+	mapping := m.mapping
 	m.Data = nil
+	m.mapping = nil
 	runtime.SetFinalizer(m, nil)
-	return syscall.Munmap(data)
+	return syscall.Munmap(mapping)
 }
 
-type MmapAlloc[T any] struct {
-	v    *T
-	data []byte
+// How worker result tables are allocated.
+type AllocMode int
+
+const (
+	// Explicit 2 MiB pages from the vm.nr_hugepages pool, failing when it is exhausted
+	AllocHugeTLB AllocMode = iota
+	// Normal anonymous memory, advised for transparent huge pages
+	AllocTHP
+	// The Go heap, without NUMA binding
+	AllocHeap
+)
+
+func ParseAllocMode(s string) (AllocMode, error) {
+	switch s {
+	case "hugetlb":
+		return AllocHugeTLB, nil
+	case "thp":
+		return AllocTHP, nil
+	case "heap":
+		return AllocHeap, nil
+	}
+	return 0, fmt.Errorf("unknown allocation mode %q, expected hugetlb, thp or heap", s)
 }
 
-func (m *MmapAlloc[T]) Close() error {
-	datax := m.data
-	m.data = nil
-	runtime.SetFinalizer(m, nil)
-	return syscall.Munmap(datax)
+// Returns the value and the mapping it lives in, nil for AllocHeap. Unmapping the
+// mapping frees the value; nothing else does.
+func Alloc[T any](size int, mode AllocMode) (*T, []byte, error) {
+	return AllocOnNode[T](size, -1, mode)
 }
 
-func Alloc[T any](size int) (*T, error) {
-	data, err := syscall.Mmap(
-		-1,
-		0,
-		size,
-		syscall.PROT_WRITE|syscall.PROT_READ,
-		syscall.MAP_PRIVATE|syscall.MAP_HUGETLB|syscall.MAP_ANONYMOUS,
-	)
+// Default huge page size on x86-64
+const hugePageSize = 2 << 20
+
+// Like Alloc, with the pages bound to a NUMA node. Node -1 means no binding.
+func AllocOnNode[T any](size int, node int, mode AllocMode) (*T, []byte, error) {
+	if mode == AllocHeap {
+		return new(T), nil, nil
+	}
+	// The kernel rounds huge page mappings up anyway, but mbind wants the exact length
+	size = (size + hugePageSize - 1) &^ (hugePageSize - 1)
+	flags := syscall.MAP_PRIVATE | syscall.MAP_ANONYMOUS
+	if mode == AllocHugeTLB {
+		flags |= syscall.MAP_HUGETLB
+	}
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_WRITE|syscall.PROT_READ, flags)
 	if err != nil {
-		return nil, err
+		if mode == AllocHugeTLB {
+			return nil, nil, &HugePageError{Size: size, Err: err}
+		}
+		return nil, nil, err
 	}
-	v := (*T)(unsafe.Pointer(&data[0]))
-	m := &MmapAlloc[T]{v: v, data: data}
-	runtime.SetFinalizer(m, (*MmapAlloc[T]).Close)
-	return m.v, nil
+	if mode == AllocTHP {
+		// Only a hint, without THP enabled this is plain memory
+		syscall.Madvise(data, syscall.MADV_HUGEPAGE)
+	}
+	if node >= 0 {
+		if err := Mbind(data, node); err != nil {
+			syscall.Munmap(data)
+			return nil, nil, err
+		}
+	}
+	return (*T)(unsafe.Pointer(&data[0])), data, nil
 }
 
-func NewMmapFile(filename string, pad int) (*MmapFile, error) {
+// Maps the file followed by at least pad zero bytes, so parsers can read a little past
+// the last record. Padding within the file's last page is zero anyway, but when the file
+// ends on a page boundary there is no such room, and touching the next page of a file
+// mapping raises SIGBUS. So the whole range is first reserved as anonymous memory and
+// the file is mapped over its start with MAP_FIXED, leaving zero pages behind it.
+// Without populate, pages are faulted in by whichever thread reads them first, which
+// places them in that thread's NUMA node.
+func NewMmapFile(filename string, pad int, populate bool) (*MmapFile, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -57,21 +103,43 @@ func NewMmapFile(filename string, pad int) (*MmapFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	size := fi.Size()
-	data, err := syscall.Mmap(
-		int(f.Fd()),
+	size := int(fi.Size())
+	pageSize := os.Getpagesize()
+	mapping, err := syscall.Mmap(
+		-1,
 		0,
-		int(size)+pad,
+		(size+pad+pageSize-1)&^(pageSize-1),
 		syscall.PROT_READ,
-		syscall.MAP_SHARED|syscall.MAP_POPULATE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS,
 	)
 	if err != nil {
 		return nil, err
 	}
-	if err := syscall.Madvise(data, syscall.MADV_SEQUENTIAL); err != nil {
+	m := &MmapFile{Data: mapping[:size], mapping: mapping}
+	runtime.SetFinalizer(m, (*MmapFile).Close)
+	if size == 0 {
+		return m, nil
+	}
+	flags := syscall.MAP_SHARED | syscall.MAP_FIXED
+	if populate {
+		flags |= syscall.MAP_POPULATE
+	}
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_MMAP,
+		uintptr(unsafe.Pointer(&mapping[0])),
+		uintptr(size),
+		syscall.PROT_READ,
+		uintptr(flags),
+		f.Fd(),
+		0,
+	)
+	if errno != 0 {
+		m.Close()
+		return nil, errno
+	}
+	if err := syscall.Madvise(m.Data, syscall.MADV_SEQUENTIAL); err != nil {
+		m.Close()
 		return nil, err
 	}
-	m := &MmapFile{Data: data[:len(data)-pad]}
-	runtime.SetFinalizer(m, (*MmapFile).Close)
 	return m, nil
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+type NumaNode struct {
+	ID   int
+	CPUs []int
+}
+
+// Nodes with CPUs, from /sys/devices/system/node/nodeN/cpulist.
+func NumaTopology() ([]NumaNode, error) {
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	nodes := []NumaNode{}
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		list, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		if len(strings.TrimSpace(string(list))) == 0 {
+			// Memory-only node
+			continue
+		}
+		cpus, err := ParseCPUList(strings.TrimSpace(string(list)))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, NumaNode{ID: id, CPUs: cpus})
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no NUMA nodes found in /sys/devices/system/node")
+	}
+	slices.SortFunc(nodes, func(a, b NumaNode) int { return a.ID - b.ID })
+	return nodes, nil
+}
+
+// Restricts the schedule to nodes, keeping only CPUs that were already selected (or
+// allowed, if none were). CPUs are interleaved across nodes so that fewer workers than
+// CPUs still spread over all nodes.
+func (s *ScheduleOptions) UseNUMA(nodes []NumaNode) error {
+	selected := s.CPUs
+	if len(selected) == 0 {
+		var err error
+		if selected, err = AllowedCPUs(); err != nil {
+			return err
+		}
+	}
+	perNode := [][]int{}
+	s.Nodes = nil
+	for _, node := range nodes {
+		cpus := slices.DeleteFunc(slices.Clone(node.CPUs), func(cpu int) bool {
+			return !slices.Contains(selected, cpu)
+		})
+		if len(cpus) == 0 {
+			continue
+		}
+		s.Nodes = append(s.Nodes, NumaNode{ID: node.ID, CPUs: cpus})
+		perNode = append(perNode, cpus)
+	}
+	if len(s.Nodes) == 0 {
+		return fmt.Errorf("no selected CPUs on any NUMA node")
+	}
+	longest := 0
+	for _, cpus := range perNode {
+		longest = max(longest, len(cpus))
+	}
+	s.CPUs = nil
+	for i := range longest {
+		for _, cpus := range perNode {
+			if i < len(cpus) {
+				s.CPUs = append(s.CPUs, cpus[i])
+			}
+		}
+	}
+	return nil
+}
+
+// Index into Nodes of the node worker runs on, 0 when not NUMA aware.
+func (s *ScheduleOptions) homeRegion(worker int) int {
+	if len(s.Nodes) == 0 {
+		return 0
+	}
+	cpu := s.CPUs[worker%len(s.CPUs)]
+	return slices.IndexFunc(s.Nodes, func(node NumaNode) bool { return slices.Contains(node.CPUs, cpu) })
+}
+
+// NUMA node ID for worker's allocations, -1 when not NUMA aware.
+func (s *ScheduleOptions) workerNode(worker int) int {
+	if len(s.Nodes) == 0 {
+		return -1
+	}
+	return s.Nodes[s.homeRegion(worker)].ID
+}
+
+// One region per node, sized by the number of workers on it, so each node mostly reads
+// its own part of the input and faults it into local page cache. offset is where data
+// starts in the file.
+func (s *ScheduleOptions) NewScheduler(data []byte, offset int64) *ChunkScheduler {
+	if len(s.Nodes) == 0 {
+		return NewChunkScheduler(data, offset, s.ChunkSize)
+	}
+	weights := make([]int, len(s.Nodes))
+	for worker := range s.Workers {
+		weights[s.homeRegion(worker)]++
+	}
+	return NewRegionChunkScheduler(data, offset, s.ChunkSize, weights)
+}
+
+const mpolBind = 2
+
+// Binds the pages of data, which must not have been touched yet, to node.
+func Mbind(data []byte, node int) error {
+	var nodeMask [16]uint64
+	nodeMask[node/64] |= 1 << (node % 64)
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_MBIND,
+		uintptr(unsafe.Pointer(&data[0])),
+		uintptr(len(data)),
+		mpolBind,
+		uintptr(unsafe.Pointer(&nodeMask)),
+		uintptr(len(nodeMask)*64+1),
+		0,
+	)
+	if errno != 0 {
+		return fmt.Errorf("mbind to node %d: %w", node, errno)
+	}
+	return nil
+}
+
+// Samples up to samples pages of data and counts which node each is resident on.
+// Pages not yet faulted in are counted under -1.
+func PageNodes(data []byte, samples int) (map[int]int, error) {
+	pageSize := os.Getpagesize()
+	pages := (len(data) + pageSize - 1) / pageSize
+	samples = min(samples, pages)
+	if samples == 0 {
+		return map[int]int{}, nil
+	}
+	addrs := make([]uintptr, samples)
+	for i := range addrs {
+		addrs[i] = uintptr(unsafe.Pointer(&data[(pages*i/samples)*pageSize]))
+	}
+	status := make([]int32, samples)
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_MOVE_PAGES,
+		0,
+		uintptr(samples),
+		uintptr(unsafe.Pointer(&addrs[0])),
+		0,
+		uintptr(unsafe.Pointer(&status[0])),
+		0,
+	)
+	if errno != 0 {
+		return nil, fmt.Errorf("move_pages: %w", errno)
+	}
+	counts := map[int]int{}
+	for _, node := range status {
+		counts[max(int(node), -1)]++
+	}
+	return counts, nil
+}
+
+// Prints which CPUs, workers, input region and page cache each node ended up with.
+func ReportNUMAPlacement(schedule *ScheduleOptions, scheduler *ChunkScheduler) {
+	workers := make([]int, len(schedule.Nodes))
+	for worker := range schedule.Workers {
+		workers[schedule.homeRegion(worker)]++
+	}
+	regions := scheduler.Regions()
+	for i := range regions {
+		region := &regions[i]
+		node := schedule.Nodes[i]
+		fmt.Fprintf(os.Stderr, "NUMA node %d: CPUs %v, %d workers, input bytes [%d, %d)",
+			node.ID, node.CPUs, workers[i], region.Start, region.End)
+		if region.End > region.Start {
+			if pageNodes, err := PageNodes(scheduler.data[region.Start:region.End], 1024); err != nil {
+				fmt.Fprintf(os.Stderr, ", page placement unknown: %v", err)
+			} else {
+				fmt.Fprintf(os.Stderr, ", sampled pages per node %v", pageNodes)
+			}
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+}
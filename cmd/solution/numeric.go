@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// The fast path only understands [-]d?d.d, stored as Decimal1_16. NumberFormat describes
+// anything else: up to Digits fractional digits and absolute values up to Range (may be
+// +Inf), accumulated in int64 fixed point with Digits decimals.
+type NumberFormat struct {
+	Digits int
+	Range  float64
+}
+
+var Decimal1Format = NumberFormat{Digits: 1, Range: 99.9}
+
+// How much of the input DetectNumberFormat looks at
+const detectSampleSize = 1 << 20
+
+func (f NumberFormat) Scale() int64 {
+	scale := int64(1)
+	for range f.Digits {
+		scale *= 10
+	}
+	return scale
+}
+
+func (f NumberFormat) FitsDecimal1Lookup() bool {
+	return f.Digits == 1 && f.Range <= Decimal1Format.Range
+}
+
+// Guesses the format from the records at the start of data, and whether they all have
+// the exact shape the lookup table handles. The detected Range is unbounded since the
+// rest of the input is unseen; values that do not fit Digits are reported as errors by
+// the wide parser, not silently misread.
+func DetectNumberFormat(data []byte, dialect *Dialect) (NumberFormat, bool, error) {
+	format := NumberFormat{Digits: 1, Range: math.Inf(1)}
+	maxAbs := 0.0
+	fitsLookup := true
+	sample := data[:min(len(data), detectSampleSize)]
+	for pos := 0; pos < len(sample); {
+		eol := bytes.IndexByte(sample[pos:], '\n')
+		if eol < 0 {
+			if len(sample) != len(data) {
+				// Partial record at the end of the sample
+				break
+			}
+			eol = len(sample) - pos
+		}
+		line := bytes.TrimSuffix(sample[pos:pos+eol], []byte("\r"))
+		lineStart := pos
+		pos += eol + 1
+		// Quoted names may contain the delimiter, numbers never do
+		delimiter := bytes.LastIndex(line, dialect.Delimiter)
+		if delimiter <= 0 {
+			return format, false, malformedAt(lineStart, recordError(line, dialect))
+		}
+		value := line[delimiter+len(dialect.Delimiter):]
+		digits := 0
+		if dot := bytes.IndexByte(value, '.'); dot >= 0 {
+			digits = len(value) - dot - 1
+		}
+		format.Digits = max(format.Digits, digits)
+		f, err := strconv.ParseFloat(string(value), 64)
+		if err != nil {
+			return format, false, malformedAt(lineStart, fmt.Errorf("invalid measurement %q", value))
+		}
+		maxAbs = max(maxAbs, math.Abs(f))
+		fitsLookup = fitsLookup && digits == 1
+	}
+	fitsLookup = fitsLookup && format.Digits == 1 && maxAbs <= Decimal1Format.Range
+	return format, fitsLookup, nil
+}
+
+// Parses "[-]digits[.digits]" terminated by "\n" or "\r\n" at data[pos:], returning
+// the value scaled to digits decimals and the position after the line ending.
+func ParseFixed(data []byte, pos int, digits int) (int64, int, error) {
+	start := pos
+	negative := false
+	if data[pos] == '-' {
+		negative = true
+		pos++
+	}
+	value := int64(0)
+	fraction := -1
+	seenDigit := false
+	for ; pos < len(data) && data[pos] != '\n'; pos++ {
+		c := data[pos]
+		switch {
+		case c == '\r' && pos+1 < len(data) && data[pos+1] == '\n':
+			continue
+		case c >= '0' && c <= '9':
+			if fraction >= 0 {
+				if fraction == digits {
+					return 0, pos, fmt.Errorf("too many fractional digits in %q", data[start:pos+1])
+				}
+				fraction++
+			}
+			if value > (math.MaxInt64-9)/10 {
+				return 0, pos, fmt.Errorf("measurement out of range: %q", data[start:pos+1])
+			}
+			value = value*10 + int64(c-'0')
+			seenDigit = true
+		case c == '.' && fraction < 0:
+			fraction = 0
+		default:
+			return 0, pos, fmt.Errorf("invalid measurement %q", data[start:pos+1])
+		}
+	}
+	if !seenDigit {
+		return 0, pos, fmt.Errorf("invalid measurement %q", data[start:pos])
+	}
+	for range digits - max(fraction, 0) {
+		value *= 10
+	}
+	if negative {
+		value = -value
+	}
+	return value, pos + 1, nil
+}
+
+type WideStationData struct {
+	Id           IdentityHash
+	Name         string
+	Sum          int64
+	Min, Max     int64
+	Count        uint32
+	Above, Below uint32
+}
+
+func (w *WideStationData) Update(measurement int64, thresholds *WideThresholds) {
+	w.Count += 1
+	w.Sum += measurement
+	w.Min = min(w.Min, measurement)
+	w.Max = max(w.Max, measurement)
+	if measurement > thresholds.Heat {
+		w.Above++
+	}
+	if measurement < thresholds.Frost {
+		w.Below++
+	}
+}
+
+func (w *WideStationData) Merge(q *WideStationData) {
+	w.Count += q.Count
+	w.Sum += q.Sum
+	w.Min = min(w.Min, q.Min)
+	w.Max = max(w.Max, q.Max)
+	w.Above += q.Above
+	w.Below += q.Below
+}
+
+// Thresholds in the scale of a NumberFormat
+type WideThresholds struct {
+	Heat, Frost int64
+}
+
+func NoWideThresholds() WideThresholds {
+	return WideThresholds{Heat: math.MaxInt64, Frost: math.MinInt64}
+}
+
+// Parses a threshold like "-12.3" into the fixed point scale of format.
+func (f NumberFormat) ParseThreshold(s string) (int64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(v * float64(f.Scale()))), nil
+}
+
+func (f NumberFormat) ToFloat(v int64) float64 {
+	return float64(v) / float64(f.Scale())
+}
+
+type WideResults map[IdentityHash]*WideStationData
+
+func (p WideResults) MergeFrom(q WideResults) error {
+	for id, qItem := range q {
+		if pItem, ok := p[id]; ok {
+			pItem.Merge(qItem)
+		} else {
+			p[id] = qItem
+		}
+	}
+	return nil
+}
+
+func IterWideInto(data []byte, results WideResults, format NumberFormat, thresholds *WideThresholds, dialect *Dialect) error {
+	var scratch []byte
+	limit := int64(math.MaxInt64)
+	if scaled := format.Range * float64(format.Scale()); scaled < math.MaxInt64 {
+		limit = int64(math.Round(scaled))
+	}
+	pos := 0
+	end := len(data)
+	for pos < end {
+		// Read name
+		recordStart := pos
+		name, next, err := dialect.readName(data, pos, &scratch)
+		if err != nil {
+			return malformedAt(recordStart, err)
+		}
+		id := IdentityHash(xxhash.Sum64(name))
+		pos = next + len(dialect.Delimiter)
+		if pos >= end {
+			return nameError(data, recordStart, dialect)
+		}
+		// Read measurement
+		measurement, next, err := ParseFixed(data, pos, format.Digits)
+		if err != nil {
+			return malformedAt(recordStart, err)
+		}
+		if measurement > limit || measurement < -limit {
+			return malformedAt(recordStart, fmt.Errorf("measurement out of range: %q", bytes.TrimRight(data[pos:min(next, len(data))], "\r\n")))
+		}
+		pos = next
+		// Update map
+		if item, ok := results[id]; ok {
+			item.Update(measurement, thresholds)
+		} else {
+			item := &WideStationData{
+				Id:    id,
+				Name:  string(name),
+				Sum:   measurement,
+				Min:   measurement,
+				Max:   measurement,
+				Count: 1,
+			}
+			if measurement > thresholds.Heat {
+				item.Above = 1
+			}
+			if measurement < thresholds.Frost {
+				item.Below = 1
+			}
+			results[id] = item
+		}
+	}
+	return nil
+}
+
+func processWideParallel(source ChunkSource, format NumberFormat, thresholds *WideThresholds, dialect *Dialect, schedule *ScheduleOptions, timings *Timings) (WideResults, error) {
+	resultsCh := make(chan WideResults, schedule.Workers)
+	group := newWorkerGroup()
+	timings.StartWorkers(schedule.Workers)
+	for worker := range schedule.Workers {
+		group.Go(func() error {
+			if err := schedule.pinWorker(worker); err != nil {
+				return err
+			}
+			timing := timings.Worker(worker)
+			results := WideResults{}
+			endParse := timing.StartParse()
+			for offset, chunk := range source.Chunks(schedule.homeRegion(worker)) {
+				if group.Failed() {
+					return nil
+				}
+				timing.Chunk(len(chunk))
+				if err := IterWideInto(chunk, results, format, thresholds, dialect); err != nil {
+					return inChunk(err, offset)
+				}
+			}
+			endParse(results.Rows)
+			resultsCh <- results
+			return nil
+		})
+	}
+	stats, err := MergeAsFinished(resultsCh, schedule.Workers, group)
+	timings.WorkersDone()
+	return stats, err
+}
+
+func (p WideResults) Rows() int64 {
+	rows := int64(0)
+	for _, item := range p {
+		rows += int64(item.Count)
+	}
+	return rows
+}
+
+// Stations sorted by name, so output does not follow map order.
+func (p WideResults) Sorted() []*WideStationData {
+	items := make([]*WideStationData, 0, len(p))
+	for _, item := range p {
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b *WideStationData) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return items
+}
+
+// Slow path of the Decimal1_16 parsers, for records the lookup does not cover: any
+// ParseFixed number with at most one decimal that fits, such as "100.5", "5" or one
+// without a trailing newline. Kept out of line so the fast path stays small.
+//
+//go:noinline
+func ParseDecimal1At(data []byte, pos int) (Decimal1_16, int, error) {
+	if pos >= len(data) {
+		return 0, pos + 1, fmt.Errorf("missing measurement at end of input")
+	}
+	value, next, err := ParseFixed(data, pos, 1)
+	if err != nil {
+		return 0, next, err
+	}
+	if value > math.MaxInt16 || value < -math.MaxInt16 {
+		return 0, next, fmt.Errorf("measurement out of range: %q", bytes.TrimRight(data[pos:min(next, len(data))], "\r\n"))
+	}
+	return Decimal1_16(value), next, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+type OutputFormat int
+
+const (
+	// name;max;min;mean lines, as in the original challenge
+	OutputText OutputFormat = iota
+	// Comma separated with a header row
+	OutputCSV
+	// One object with a list of stations and, with GROUPS_FILE, of groups
+	OutputJSON
+)
+
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch s {
+	case "text":
+		return OutputText, nil
+	case "csv":
+		return OutputCSV, nil
+	case "json":
+		return OutputJSON, nil
+	}
+	return 0, fmt.Errorf("unknown output format %q, expected text, csv or json", s)
+}
+
+// One line of output, a station or a group, per time bucket with TIME_WINDOW.
+type ResultRow struct {
+	Name string
+	// Formatted bucket start, empty unless TIME_WINDOW is set
+	Bucket         string
+	Max, Min, Mean float64
+	Count          int64
+	Above, Below   uint32
+}
+
+// Everything a run produces, before formatting.
+type Aggregate struct {
+	Stations []ResultRow
+	// GROUPS_FILE rollups, sorted by name
+	Groups []ResultRow
+	// Decimals to print values with
+	Digits int
+	// Whether Above and Below were counted
+	Thresholds bool
+}
+
+func decimal1Row(item *WeatherStationData, bucket string) ResultRow {
+	return ResultRow{
+		Name:   item.Name,
+		Bucket: bucket,
+		Max:    Decimal1_16ToFloat(item.Max),
+		Min:    Decimal1_16ToFloat(item.Min),
+		Mean:   Decimal1_64ToFloat(item.Sum) / float64(item.Count),
+		Count:  int64(item.Count),
+		Above:  item.Above,
+		Below:  item.Below,
+	}
+}
+
+func wideRow(item *WideStationData, format NumberFormat) ResultRow {
+	return ResultRow{
+		Name:  item.Name,
+		Max:   format.ToFloat(item.Max),
+		Min:   format.ToFloat(item.Min),
+		Mean:  format.ToFloat(item.Sum) / float64(item.Count),
+		Count: int64(item.Count),
+		Above: item.Above,
+		Below: item.Below,
+	}
+}
+
+func (a *Aggregate) Write(w io.Writer, format OutputFormat) error {
+	out := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case OutputText:
+		a.writeText(out)
+	case OutputCSV:
+		err = a.writeCSV(out)
+	case OutputJSON:
+		err = a.writeJSON(out)
+	}
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Group results follow the station results after a blank line.
+func (a *Aggregate) writeText(w *bufio.Writer) {
+	for i, rows := range [][]ResultRow{a.Stations, a.Groups} {
+		if i > 0 {
+			if rows == nil {
+				break
+			}
+			w.WriteByte('\n')
+		}
+		for _, row := range rows {
+			w.WriteString(row.Name)
+			w.WriteByte(';')
+			if row.Bucket != "" {
+				w.WriteString(row.Bucket)
+				w.WriteByte(';')
+			}
+			fmt.Fprintf(w, "%0.*f;%0.*f;%0.*f", a.Digits, row.Max, a.Digits, row.Min, a.Digits, row.Mean)
+			if a.Thresholds {
+				fmt.Fprintf(w, ";%d;%d", row.Above, row.Below)
+			}
+			w.WriteByte('\n')
+		}
+	}
+}
+
+// Like text, groups come as a second table after a blank line, with "group" as the
+// first column's name.
+func (a *Aggregate) writeCSV(w *bufio.Writer) error {
+	for i, rows := range [][]ResultRow{a.Stations, a.Groups} {
+		header := []string{"station"}
+		if i > 0 {
+			if a.Groups == nil {
+				break
+			}
+			w.WriteByte('\n')
+			header[0] = "group"
+		}
+		if len(a.Stations) > 0 && a.Stations[0].Bucket != "" {
+			header = append(header, "bucket")
+		}
+		header = append(header, "max", "min", "mean", "count")
+		if a.Thresholds {
+			header = append(header, "above", "below")
+		}
+		out := csv.NewWriter(w)
+		out.Write(header)
+		for _, row := range rows {
+			record := []string{row.Name}
+			if row.Bucket != "" {
+				record = append(record, row.Bucket)
+			}
+			record = append(record, a.format(row.Max), a.format(row.Min), a.format(row.Mean), strconv.FormatInt(row.Count, 10))
+			if a.Thresholds {
+				record = append(record, strconv.FormatUint(uint64(row.Above), 10), strconv.FormatUint(uint64(row.Below), 10))
+			}
+			out.Write(record)
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type jsonRow struct {
+	Name   string      `json:"name"`
+	Bucket string      `json:"bucket,omitempty"`
+	Max    json.Number `json:"max"`
+	Min    json.Number `json:"min"`
+	Mean   json.Number `json:"mean"`
+	Count  int64       `json:"count"`
+	Above  *uint32     `json:"above,omitempty"`
+	Below  *uint32     `json:"below,omitempty"`
+}
+
+// Values are rounded like the text output, as numbers.
+func (a *Aggregate) writeJSON(w *bufio.Writer) error {
+	convert := func(rows []ResultRow) []jsonRow {
+		converted := make([]jsonRow, len(rows))
+		for i := range rows {
+			row := &rows[i]
+			converted[i] = jsonRow{
+				Name:   row.Name,
+				Bucket: row.Bucket,
+				Max:    json.Number(a.format(row.Max)),
+				Min:    json.Number(a.format(row.Min)),
+				Mean:   json.Number(a.format(row.Mean)),
+				Count:  row.Count,
+			}
+			if a.Thresholds {
+				converted[i].Above, converted[i].Below = &row.Above, &row.Below
+			}
+		}
+		return converted
+	}
+	document := struct {
+		Stations []jsonRow `json:"stations"`
+		Groups   []jsonRow `json:"groups,omitempty"`
+	}{convert(a.Stations), nil}
+	if a.Groups != nil {
+		document.Groups = convert(a.Groups)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+func (a *Aggregate) format(v float64) string {
+	return strconv.FormatFloat(v, 'f', a.Digits, 64)
+}
+
+type Totals struct {
+	Rows     int64
+	Stations int
+	// Distinct time buckets, zero without TIME_WINDOW
+	Buckets        int
+	Min, Max, Mean float64
+}
+
+// Over all stations, groups are left out.
+func (a *Aggregate) Totals() Totals {
+	t := Totals{Min: math.Inf(1), Max: math.Inf(-1)}
+	stations, buckets := map[string]bool{}, map[string]bool{}
+	sum := 0.0
+	for _, row := range a.Stations {
+		stations[row.Name] = true
+		if row.Bucket != "" {
+			buckets[row.Bucket] = true
+		}
+		t.Rows += row.Count
+		t.Min = min(t.Min, row.Min)
+		t.Max = max(t.Max, row.Max)
+		sum += row.Mean * float64(row.Count)
+	}
+	t.Stations, t.Buckets = len(stations), len(buckets)
+	if t.Rows > 0 {
+		t.Mean = sum / float64(t.Rows)
+	}
+	return t
+}
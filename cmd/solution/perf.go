@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Hardware counters per worker thread through perf_event_open, for -counters. Each
+// event is opened on its own, so a machine or container that lacks some of them still
+// reports the rest, and one that allows none just says why.
+type Counters struct {
+	workers []WorkerCounters
+}
+
+type perfEvent struct {
+	name string
+	// perf_event_attr type and config
+	kind   uint32
+	config uint64
+}
+
+const (
+	perfTypeHardware = 0
+	perfTypeSoftware = 1
+	perfTypeHWCache  = 3
+
+	// Cache events are cache | op<<8 | result<<16, here always read misses
+	perfCacheL1D  = 0
+	perfCacheLL   = 2
+	perfCacheDTLB = 3
+	perfCacheMiss = 1 << 16
+
+	perfFlagDisabled      = 1 << 0
+	perfFlagExcludeKernel = 1 << 5
+	perfFlagExcludeHV     = 1 << 6
+
+	// With these in read_format a read returns value, time enabled, time running
+	perfFormatTotalTimeEnabled = 1 << 0
+	perfFormatTotalTimeRunning = 1 << 1
+
+	perfIocEnable  = 0x2400
+	perfIocDisable = 0x2401
+)
+
+var perfEvents = [...]perfEvent{
+	{"cycles", perfTypeHardware, 0},
+	{"instructions", perfTypeHardware, 1},
+	{"branch-misses", perfTypeHardware, 5},
+	{"L1d-misses", perfTypeHWCache, perfCacheL1D | perfCacheMiss},
+	{"LLC-misses", perfTypeHWCache, perfCacheLL | perfCacheMiss},
+	{"dTLB-misses", perfTypeHWCache, perfCacheDTLB | perfCacheMiss},
+	// Software, so usually there even where the hardware ones are not
+	{"page-faults", perfTypeSoftware, 2},
+}
+
+// The first fields of struct perf_event_attr, PERF_ATTR_SIZE_VER0
+type perfEventAttr struct {
+	kind         uint32
+	size         uint32
+	config       uint64
+	samplePeriod uint64
+	sampleType   uint64
+	readFormat   uint64
+	flags        uint64
+	wakeupEvents uint32
+	bpType       uint32
+	config1      uint64
+}
+
+// Written only by its own worker.
+type WorkerCounters struct {
+	fds    [len(perfEvents)]int
+	values [len(perfEvents)]uint64
+	// Why each event could not be counted, nil if it was
+	errs [len(perfEvents)]error
+	rows int64
+}
+
+func NewCounters(workers int) *Counters {
+	return &Counters{workers: make([]WorkerCounters, workers)}
+}
+
+// Nil when c is nil, which WorkerCounters methods accept.
+func (c *Counters) Worker(worker int) *WorkerCounters {
+	if c == nil {
+		return nil
+	}
+	return &c.workers[worker]
+}
+
+// Opens and enables the counters for the calling thread, which must stay locked to the
+// goroutine until Stop.
+func (w *WorkerCounters) Start() {
+	if w == nil {
+		return
+	}
+	for i, event := range perfEvents {
+		w.fds[i] = -1
+		attr := perfEventAttr{
+			kind:       event.kind,
+			size:       uint32(unsafe.Sizeof(perfEventAttr{})),
+			config:     event.config,
+			readFormat: perfFormatTotalTimeEnabled | perfFormatTotalTimeRunning,
+			// User space only, which perf_event_paranoid=2 still allows
+			flags: perfFlagDisabled | perfFlagExcludeKernel | perfFlagExcludeHV,
+		}
+		// pid 0, cpu -1: this thread on whichever CPU it runs
+		fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)),
+			0, ^uintptr(0), ^uintptr(0), 0, 0)
+		if errno != 0 {
+			w.errs[i] = errno
+			continue
+		}
+		w.fds[i] = int(fd)
+	}
+	for _, fd := range w.fds {
+		if fd >= 0 {
+			syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), perfIocEnable, 0)
+		}
+	}
+}
+
+// Stops counting and records the counts for rows records.
+func (w *WorkerCounters) Stop(rows int64) {
+	if w == nil {
+		return
+	}
+	for _, fd := range w.fds {
+		if fd >= 0 {
+			syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), perfIocDisable, 0)
+		}
+	}
+	for i, fd := range w.fds {
+		if fd < 0 {
+			continue
+		}
+		var buf [3]uint64
+		n, err := syscall.Read(fd, unsafe.Slice((*byte)(unsafe.Pointer(&buf[0])), int(unsafe.Sizeof(buf))))
+		syscall.Close(fd)
+		w.fds[i] = -1
+		if err == nil && n != int(unsafe.Sizeof(buf)) {
+			err = fmt.Errorf("short read")
+		}
+		if err != nil {
+			w.errs[i] = err
+			continue
+		}
+		value, enabled, running := buf[0], buf[1], buf[2]
+		if running == 0 {
+			w.errs[i] = fmt.Errorf("never scheduled on the PMU")
+			continue
+		}
+		if running < enabled {
+			// Multiplexed with other events, scale up to the whole time
+			value = uint64(float64(value) * float64(enabled) / float64(running))
+		}
+		w.values[i] = value
+	}
+	w.rows = rows
+}
+
+// Closes the counters Stop did not get to, leaving them uncounted. Safe to call more
+// than once, so it can be deferred right after Start to cover early returns.
+func (w *WorkerCounters) Close() {
+	if w == nil {
+		return
+	}
+	for i, fd := range w.fds {
+		if fd < 0 {
+			continue
+		}
+		syscall.Close(fd)
+		w.fds[i] = -1
+		w.errs[i] = errNotStopped
+	}
+}
+
+var errNotStopped = errors.New("stopped before the end of parsing")
+
+// One line per worker and a total: IPC and each event per row. Events no worker could
+// count are listed with the reason instead of a column.
+func (c *Counters) Report(out io.Writer) {
+	if c == nil || len(c.workers) == 0 {
+		return
+	}
+	var columns []int
+	// Events by why they are missing, in order of first appearance
+	var reasons []string
+	missing := map[string][]string{}
+	for i, event := range perfEvents {
+		var err error
+		for w := range c.workers {
+			if err = c.workers[w].errs[i]; err == nil {
+				break
+			}
+		}
+		if err == nil {
+			columns = append(columns, i)
+			continue
+		}
+		reason := perfErrorReason(err)
+		if missing[reason] == nil {
+			reasons = append(reasons, reason)
+		}
+		missing[reason] = append(missing[reason], event.name)
+	}
+	reportMissing := func(heading string) {
+		for _, reason := range reasons {
+			fmt.Fprintf(out, "%s: %s (%s)\n", heading, strings.Join(missing[reason], ", "), reason)
+		}
+	}
+	if len(columns) == 0 {
+		reportMissing("Counters unavailable")
+		return
+	}
+	fmt.Fprintf(out, "%6s %11s", "Worker", "rows")
+	hasIPC := slices.Contains(columns, 0) && slices.Contains(columns, 1)
+	if hasIPC {
+		fmt.Fprintf(out, " %6s", "IPC")
+	}
+	for _, i := range columns {
+		fmt.Fprintf(out, " %14s", perfEvents[i].name+"/row")
+	}
+	fmt.Fprintln(out)
+	line := func(label string, rows int64, ipc float64, perRow *[len(perfEvents)]float64) {
+		fmt.Fprintf(out, "%6s %11d", label, rows)
+		if hasIPC {
+			if math.IsNaN(ipc) {
+				fmt.Fprintf(out, " %6s", "-")
+			} else {
+				fmt.Fprintf(out, " %6.2f", ipc)
+			}
+		}
+		for _, i := range columns {
+			if math.IsNaN(perRow[i]) {
+				fmt.Fprintf(out, " %14s", "-")
+				continue
+			}
+			fmt.Fprintf(out, " %14.4g", perRow[i])
+		}
+		fmt.Fprintln(out)
+	}
+	// Each total only covers the workers that counted the event, so one that could
+	// not does not water it down. NaN where no worker did.
+	var totals, totalRows [len(perfEvents)]uint64
+	var cycles, instructions uint64
+	countedIPC := false
+	var rows int64
+	for i := range c.workers {
+		w := &c.workers[i]
+		ipc := math.NaN()
+		if w.errs[0] == nil && w.errs[1] == nil {
+			ipc = ratio(w.values[1], w.values[0])
+			cycles += w.values[0]
+			instructions += w.values[1]
+			countedIPC = true
+		}
+		var perRow [len(perfEvents)]float64
+		for j := range perfEvents {
+			perRow[j] = math.NaN()
+			if w.errs[j] == nil {
+				perRow[j] = ratio(w.values[j], uint64(w.rows))
+				totals[j] += w.values[j]
+				totalRows[j] += uint64(w.rows)
+			}
+		}
+		rows += w.rows
+		line(fmt.Sprint(i), w.rows, ipc, &perRow)
+	}
+	ipc := math.NaN()
+	if countedIPC {
+		ipc = ratio(instructions, cycles)
+	}
+	var perRow [len(perfEvents)]float64
+	for j := range perfEvents {
+		perRow[j] = math.NaN()
+		if totalRows[j] > 0 {
+			perRow[j] = ratio(totals[j], totalRows[j])
+		}
+	}
+	line("all", rows, ipc, &perRow)
+	reportMissing("Not counted")
+}
+
+func perfErrorReason(err error) string {
+	switch err {
+	case syscall.ENOENT, syscall.EOPNOTSUPP, syscall.EINVAL:
+		return "not supported by this CPU or VM"
+	case syscall.EACCES, syscall.EPERM:
+		return "not permitted, lower kernel.perf_event_paranoid or grant CAP_PERFMON"
+	case syscall.ENOSYS:
+		return "perf_event_open is blocked, as by the default seccomp profile of some container runtimes"
+	}
+	return err.Error()
+}
+
+func ratio(a, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
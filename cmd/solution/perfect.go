@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/bits"
+	"os"
+	"slices"
+	"unsafe"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Minimal perfect hash over a fixed set of station names, built hash-and-displace
+// style: keys are spread over buckets, and each bucket gets the first seed that places
+// all of its keys in free slots. Lookups cost one key mix, one seed load and a few word
+// comparisons, instead of xxhash and probing.
+type PerfectHash struct {
+	seeds []uint32
+	slots []perfectSlot
+}
+
+type perfectSlot struct {
+	// Words of the name as read by nameWords, which cover names of up to 16 bytes entirely
+	head, tail uint64
+	length     int
+	name       string
+	id         IdentityHash
+}
+
+// Gives up on a bucket after this many seeds
+const perfectHashMaxSeed = 1 << 24
+
+// Reads one station name per line, skipping blank lines and duplicates.
+func LoadStationList(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := []string{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := scanner.Text()
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
+
+func NewPerfectHash(names []string) (*PerfectHash, error) {
+	n := len(names)
+	if n == 0 {
+		return nil, fmt.Errorf("empty station list")
+	}
+	keys := make([]uint64, n)
+	byKey := map[uint64]string{}
+	for i, name := range names {
+		head, tail := nameWords([]byte(name))
+		keys[i] = stationKey(head, tail, len(name))
+		if other, ok := byKey[keys[i]]; ok {
+			return nil, fmt.Errorf("stations %q and %q have the same key", other, name)
+		}
+		byKey[keys[i]] = name
+	}
+	h := &PerfectHash{
+		seeds: make([]uint32, (n+1)/2),
+		slots: make([]perfectSlot, n),
+	}
+	buckets := make([][]int, len(h.seeds))
+	for i, key := range keys {
+		b := h.bucket(key)
+		buckets[b] = append(buckets[b], i)
+	}
+	// Largest buckets first, while most slots are still free
+	order := make([]uint32, len(buckets))
+	for i := range order {
+		order[i] = uint32(i)
+	}
+	slices.SortStableFunc(order, func(a, b uint32) int { return len(buckets[b]) - len(buckets[a]) })
+	taken := make([]bool, n)
+	for _, b := range order {
+		if len(buckets[b]) == 0 {
+			break
+		}
+		slots, ok := h.place(keys, buckets[b], b, taken)
+		if !ok {
+			return nil, fmt.Errorf("no perfect hash seed found for %d stations", n)
+		}
+		for j, i := range buckets[b] {
+			taken[slots[j]] = true
+			head, tail := nameWords([]byte(names[i]))
+			h.slots[slots[j]] = perfectSlot{
+				head:   head,
+				tail:   tail,
+				length: len(names[i]),
+				name:   names[i],
+				id:     IdentityHash(xxhash.Sum64String(names[i])),
+			}
+		}
+	}
+	return h, nil
+}
+
+// Finds the first seed for bucket b that puts all of its keys in distinct free slots.
+func (h *PerfectHash) place(keys []uint64, bucket []int, b uint32, taken []bool) ([]uint32, bool) {
+	slots := make([]uint32, 0, len(bucket))
+seeds:
+	for seed := range uint32(perfectHashMaxSeed) {
+		slots = slots[:0]
+		for _, i := range bucket {
+			slot := h.slot(keys[i], seed)
+			if taken[slot] || slices.Contains(slots, slot) {
+				continue seeds
+			}
+			slots = append(slots, slot)
+		}
+		h.seeds[b] = seed
+		return slots, true
+	}
+	return nil, false
+}
+
+func (h *PerfectHash) Len() int {
+	return len(h.slots)
+}
+
+// The first and last eight bytes of name, overlapping for short names. Names under eight
+// bytes are all in head. Within the input there is always room to read eight bytes from
+// the start of a name, short ones are then masked instead of assembled bytewise.
+func nameWords(name []byte) (uint64, uint64) {
+	if len(name) >= 8 {
+		return *(*uint64)(unsafe.Pointer(&name[0])), *(*uint64)(unsafe.Pointer(&name[len(name)-8]))
+	}
+	if cap(name) >= 8 {
+		return *(*uint64)(unsafe.Pointer(unsafe.SliceData(name))) & (1<<(8*len(name)) - 1), 0
+	}
+	var head uint64
+	for i, c := range name {
+		head |= uint64(c) << (8 * i)
+	}
+	return head, 0
+}
+
+// Cheap to compute but well mixed. Station names that share both words and the length
+// get the same key, which NewPerfectHash rejects.
+func stationKey(head, tail uint64, length int) uint64 {
+	k := (head ^ bits.RotateLeft64(tail, 29) ^ uint64(length)) * 0x9e3779b97f4a7c15
+	return k ^ k>>29
+}
+
+func (h *PerfectHash) bucket(key uint64) uint32 {
+	return uint32((key >> 32) * uint64(len(h.seeds)) >> 32)
+}
+
+func (h *PerfectHash) slot(key uint64, seed uint32) uint32 {
+	mixed := (key ^ uint64(seed)) * 0xbf58476d1ce4e5b9
+	return uint32((mixed >> 32) * uint64(len(h.slots)) >> 32)
+}
+
+// Slot of name, or -1 if it is not in the set. Only names over 16 bytes need more than
+// the word comparison.
+func (h *PerfectHash) Lookup(name []byte) int {
+	head, tail := nameWords(name)
+	key := stationKey(head, tail, len(name))
+	slot := h.slot(key, h.seeds[h.bucket(key)])
+	s := &h.slots[slot]
+	if s.head != head || s.tail != tail || s.length != len(name) {
+		return -1
+	}
+	if len(name) > 16 && s.name[8:len(name)-8] != string(name[8:len(name)-8]) {
+		return -1
+	}
+	return int(slot)
+}
+
+// A worker's stats for the stations in a PerfectHash, indexed by slot.
+type KnownResults struct {
+	hash  *PerfectHash
+	items []stationEntry
+}
+
+func (h *PerfectHash) NewResults() *KnownResults {
+	k := &KnownResults{hash: h, items: make([]stationEntry, h.Len())}
+	for i := range k.items {
+		k.items[i].Id = h.slots[i].id
+	}
+	return k
+}
+
+// Same contract as ProcessedResults.get, except that both are nil for unknown names.
+// New items already have their Id set, names are only added by FlushInto.
+func (k *KnownResults) get(name []byte) (*stationEntry, *stationEntry) {
+	slot := k.hash.Lookup(name)
+	if slot < 0 {
+		return nil, nil
+	}
+	if k.items[slot].Count == 0 {
+		return nil, &k.items[slot]
+	}
+	return &k.items[slot], nil
+}
+
+// Moves the known stations' stats into results, where unknown stations already are.
+func (k *KnownResults) FlushInto(results *ProcessedResults) error {
+	for i := range k.items {
+		if k.items[i].Empty() {
+			continue
+		}
+		name := k.hash.slots[i].name
+		if err := results.add(&k.items[i], unsafe.Slice(unsafe.StringData(name), len(name))); err != nil {
+			return err
+		}
+		id := k.items[i].Id
+		k.items[i] = stationEntry{}
+		k.items[i].Id = id
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Bytes parsed so far, for -progress. Workers add each chunk once they are done with
+// it, and a ticker prints throughput, percentage and ETA to stderr: redrawn in place
+// on a terminal, otherwise as a line every few seconds so logs stay readable. A nil
+// *Progress counts nothing.
+type Progress struct {
+	out  io.Writer
+	tty  bool
+	size int64
+	// One per Chunks call, so normally one per worker
+	workers []workerProgress
+	next    atomic.Int64
+	start   time.Time
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	once    sync.Once
+	aborted bool
+}
+
+type workerProgress struct {
+	bytes atomic.Int64
+	// Keep each worker's counter on its own cache line
+	_ [56]byte
+}
+
+const (
+	progressRedraw   = 200 * time.Millisecond
+	progressLogEvery = 5 * time.Second
+)
+
+// Starts the ticker on out for an input of size bytes; size 0 leaves out the
+// percentage and ETA.
+func NewProgress(out *os.File, size int64, workers int) *Progress {
+	p := &Progress{
+		out:     out,
+		tty:     isTerminal(out),
+		size:    size,
+		workers: make([]workerProgress, max(workers, 1)),
+		start:   time.Now(),
+		stop:    make(chan struct{}),
+	}
+	interval := progressLogEvery
+	if p.tty {
+		interval = progressRedraw
+	}
+	p.stopped.Add(1)
+	go p.run(interval)
+	return p
+}
+
+// Wraps source so that the chunks taken from it are counted.
+func (p *Progress) Source(source ChunkSource) ChunkSource {
+	if p == nil {
+		return source
+	}
+	return progressSource{source, p}
+}
+
+type progressSource struct {
+	ChunkSource
+	progress *Progress
+}
+
+func (s progressSource) Chunks(home int) iter.Seq2[int64, []byte] {
+	p := s.progress
+	w := &p.workers[int(p.next.Add(1)-1)%len(p.workers)]
+	return func(yield func(int64, []byte) bool) {
+		for offset, chunk := range s.ChunkSource.Chunks(home) {
+			if !yield(offset, chunk) {
+				return
+			}
+			w.bytes.Add(int64(len(chunk)))
+		}
+	}
+}
+
+func (p *Progress) Bytes() int64 {
+	var bytes int64
+	for i := range p.workers {
+		bytes += p.workers[i].bytes.Load()
+	}
+	return bytes
+}
+
+// Stops the ticker and prints the final state once everything has been parsed. Safe to
+// call more than once, and after Abort, which it then leaves alone.
+func (p *Progress) Stop() {
+	p.finish(false)
+}
+
+// Like Stop for when parsing failed: the final line says so instead of claiming it is
+// done, so deferring it covers every error return.
+func (p *Progress) Abort() {
+	p.finish(true)
+}
+
+func (p *Progress) finish(aborted bool) {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() {
+		close(p.stop)
+		p.stopped.Wait()
+		p.aborted = aborted
+		p.print(true)
+	})
+}
+
+func (p *Progress) run(interval time.Duration) {
+	defer p.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.print(false)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Progress) print(final bool) {
+	bytes := p.Bytes()
+	elapsed := time.Since(p.start)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(bytes) / elapsed.Seconds()
+	}
+	line := fmt.Sprintf("%.1f MB", float64(bytes)/1e6)
+	if p.size > 0 {
+		done := min(float64(bytes)/float64(p.size), 1)
+		line = fmt.Sprintf("%6.2f%% %s of %.1f MB", 100*done, line, float64(p.size)/1e6)
+	}
+	line += fmt.Sprintf(", %.1f MB/s", rate/1e6)
+	switch {
+	case final && p.aborted:
+		line += ", aborted after " + elapsed.Round(time.Millisecond).String()
+	case final:
+		line += ", done in " + elapsed.Round(time.Millisecond).String()
+	case p.size > 0 && rate > 0:
+		eta := time.Duration(float64(max(p.size-bytes, 0)) / rate * float64(time.Second))
+		line += ", ETA " + eta.Round(100*time.Millisecond).String()
+	}
+	if !p.tty {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+	// Back to the line start and clear what a longer previous line left
+	fmt.Fprint(p.out, "\r\x1b[K", line)
+	if final {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"iter"
+	"math"
+	"math/bits"
+	"strconv"
 	"unsafe"
 
 	"github.com/cespare/xxhash/v2"
@@ -19,159 +23,278 @@ type WeatherStationData struct {
 	Sum      Decimal1_64
 	Count    uint32
 	Min, Max Decimal1_16
+	// Readings strictly above Thresholds.Heat and strictly below Thresholds.Frost
+	Above, Below uint32
 }
 
 func (w *WeatherStationData) Empty() bool {
 	return w.Count == 0
 }
 
-func (w *WeatherStationData) Update(measurement Decimal1_16) {
+func (w *WeatherStationData) Update(measurement Decimal1_16, thresholds *Thresholds) {
 	w.Count += 1
 	w.Sum += Decimal1_64(measurement)
 	w.Min = min(w.Min, measurement)
 	w.Max = max(w.Max, measurement)
+	w.Above += thresholds.above(measurement)
+	w.Below += thresholds.below(measurement)
 }
 
-const MAP_SIZE = 32768
+func (w *WeatherStationData) Merge(q *WeatherStationData) {
+	w.Count += q.Count
+	w.Sum += q.Sum
+	w.Min = min(w.Min, q.Min)
+	w.Max = max(w.Max, q.Max)
+	w.Above += q.Above
+	w.Below += q.Below
+}
 
-type ProcessedResults struct {
-	items [MAP_SIZE]WeatherStationData
+// WeatherStationData without the name, as kept in results tables. 32 bytes, two per
+// cache line.
+type stationStats struct {
+	Id           IdentityHash
+	Sum          Decimal1_64
+	Count        uint32
+	Min, Max     Decimal1_16
+	Above, Below uint32
 }
 
-const ProcessedResultsSize = int(unsafe.Sizeof(ProcessedResults{}))
+func (w *stationStats) Empty() bool {
+	return w.Count == 0
+}
 
-func (p *ProcessedResults) MergeFrom(q *ProcessedResults) {
-	for i := range q.items {
-		if q.items[i].Count == 0 {
-			continue
-		}
-		if pItem, newItem := p.get(q.items[i].Id); newItem != nil {
-			*newItem = q.items[i]
-		} else {
-			pItem.Count += q.items[i].Count
-			pItem.Sum += q.items[i].Sum
-			pItem.Min = min(pItem.Min, q.items[i].Min)
-			pItem.Max = min(pItem.Max, q.items[i].Max)
-		}
-	}
+func (w *stationStats) Update(measurement Decimal1_16, thresholds *Thresholds) {
+	w.Count += 1
+	w.Sum += Decimal1_64(measurement)
+	w.Min = min(w.Min, measurement)
+	w.Max = max(w.Max, measurement)
+	w.Above += thresholds.above(measurement)
+	w.Below += thresholds.below(measurement)
+}
+
+func (w *stationStats) Merge(q *stationStats) {
+	w.Count += q.Count
+	w.Sum += q.Sum
+	w.Min = min(w.Min, q.Min)
+	w.Max = max(w.Max, q.Max)
+	w.Above += q.Above
+	w.Below += q.Below
 }
 
-func (p *ProcessedResults) get(id IdentityHash) (*WeatherStationData, *WeatherStationData) {
-	index := uint16(id) >> 1
-	if p.items[index].Count == 0 {
-		return nil, &p.items[index]
+func (w *stationStats) withName(name string) WeatherStationData {
+	return WeatherStationData{
+		Id:    w.Id,
+		Name:  name,
+		Sum:   w.Sum,
+		Count: w.Count,
+		Min:   w.Min,
+		Max:   w.Max,
+		Above: w.Above,
+		Below: w.Below,
 	}
-	for {
-		if p.items[index].Id == id {
-			return &p.items[index], nil
-		}
-		index = index + 1
-		if p.items[index].Count == 0 {
-			break
-		}
+}
+
+// Thresholds for counting readings of interest. Disabled thresholds are set to the
+// extremes of Decimal1_16 so they never match, keeping the hot loop unconditional.
+type Thresholds struct {
+	Heat, Frost Decimal1_16
+}
+
+func NoThresholds() Thresholds {
+	return Thresholds{Heat: math.MaxInt16, Frost: math.MinInt16}
+}
+
+// 1 if measurement > Heat, else 0. Difference fits comfortably in int32, so the
+// sign bit is the comparison result.
+func (t *Thresholds) above(measurement Decimal1_16) uint32 {
+	return uint32(int32(t.Heat)-int32(measurement)) >> 31
+}
+
+// 1 if measurement < Frost, else 0.
+func (t *Thresholds) below(measurement Decimal1_16) uint32 {
+	return uint32(int32(measurement)-int32(t.Frost)) >> 31
+}
+
+// Sets the high bit of each byte of word equal to the byte repeated in pattern or to
+// '\n', so that a scan for the delimiter stops at the end of a line that has none.
+// Exact, unlike (n-0x01..)&^n which can flag the byte above a match: '-' ^ ',' is 0x01,
+// so comma separated negative numbers would trip it.
+func detectDelimiterOrNewline(word uint64, pattern uint64) uint64 {
+	n := word ^ pattern
+	l := word ^ 0x0a0a0a0a0a0a0a0a
+	t := (n & 0x7f7f7f7f7f7f7f7f) + 0x7f7f7f7f7f7f7f7f
+	u := (l & 0x7f7f7f7f7f7f7f7f) + 0x7f7f7f7f7f7f7f7f
+	return ^((t|n)&(u|l) | 0x7f7f7f7f7f7f7f7f)
+}
+
+// The line starting at pos, without its line ending.
+func lineAt(data []byte, pos int) []byte {
+	line := data[pos:]
+	if eol := bytes.IndexByte(line, '\n'); eol >= 0 {
+		line = line[:eol]
 	}
-	return nil, &p.items[index]
+	return bytes.TrimSuffix(line, []byte("\r"))
 }
 
-func (p *ProcessedResults) Entries() iter.Seq[*WeatherStationData] {
-	return func(yield func(*WeatherStationData) bool) {
-		for i := range p.items {
-			if !p.items[i].Empty() {
-				if !yield(&p.items[i]) {
-					return
-				}
-			}
-		}
+// Why line could not be split into a station name and a measurement.
+func recordError(line []byte, dialect *Dialect) error {
+	switch {
+	case len(line) == 0:
+		return errors.New("empty line")
+	case !bytes.Contains(line, dialect.Delimiter):
+		return fmt.Errorf("no delimiter in %q", line)
+	case bytes.HasPrefix(line, dialect.Delimiter):
+		return fmt.Errorf("empty station name in %q", line)
 	}
+	return fmt.Errorf("missing measurement in %q", line)
 }
 
-func detectDelimiter(data *byte) uint64 {
-	n := *(*uint64)(unsafe.Pointer(data)) ^ (';' * 0x0101010101010101)
-	return (n - 0x0101010101010101) &^ n & 0x8080808080808080
+// For the parse loops: the name scan of the record at start found no delimiter before
+// the line ending or the end of data, or an empty name, or nothing after it.
+//
+//go:noinline
+func nameError(data []byte, start int, dialect *Dialect) error {
+	return malformedAt(start, recordError(lineAt(data, start), dialect))
 }
 
-func IterInto(data []byte, results *ProcessedResults, numberLookup *[65536]Decimal1_16) {
+// Choices for the default parser. The zero value is the plain SWAR scan with xxhash.
+type ParseOptions struct {
+	// Stations to look up through a perfect hash, skipping the general table until the
+	// worker is done. Optional.
+	Stations *PerfectHash
+	Hash     HashMode
+	Scan     ScanMode
+}
+
+type iterFunc func(data []byte, results *ProcessedResults, known *KnownResults, numberLookup *[65536]decimal1Entry, thresholds *Thresholds, dialect *Dialect) error
+
+// The parse loop for these options. SIMD scans always hash like HashFused.
+func (o *ParseOptions) Iter() iterFunc {
+	if kernel := scanKernelFor(o.Scan); kernel != nil {
+		decode := measurementKernelFor(o.Scan)
+		return func(data []byte, results *ProcessedResults, known *KnownResults, numberLookup *[65536]decimal1Entry, thresholds *Thresholds, dialect *Dialect) error {
+			return IterMaskedInto(data, results, known, numberLookup, thresholds, dialect, kernel, decode)
+		}
+	}
+	if o.Hash == HashFused {
+		return IterFusedInto
+	}
+	return IterInto
+}
+
+// Stations in known, if not nil, are counted there and everything else in results.
+func IterInto(data []byte, results *ProcessedResults, known *KnownResults, numberLookup *[65536]decimal1Entry, thresholds *Thresholds, dialect *Dialect) error {
+	pattern := dialect.pattern
+	delimiterLen := len(dialect.Delimiter)
+	var scratch []byte
 	pos := 0
 	end := len(data)
 	for pos < end {
-		// Read name
 		recordStart := pos
-		pos++
-	skipToDelim:
-		for {
-			skip := detectDelimiter(&data[pos])
-			switch skip & 0xffffffff {
-			case 0x80000000:
-				pos += 3
-				break skipToDelim
-			case 0x00800000:
-				pos += 2
-				break skipToDelim
-			case 0x00008000:
-				pos += 1
-				break skipToDelim
-			case 0x00000080:
-				break skipToDelim
+		// Read name
+		var name []byte
+		if dialect.simple {
+			for pos < end {
+				if found := detectDelimiterOrNewline(*(*uint64)(unsafe.Pointer(&data[pos])), pattern); found != 0 {
+					pos += bits.TrailingZeros64(found) >> 3
+					break
+				}
+				pos += 8
 			}
-			switch skip >> 32 {
-			case 0x80000000:
-				pos += 7
-				break skipToDelim
-			case 0x00800000:
-				pos += 6
-				break skipToDelim
-			case 0x00008000:
-				pos += 5
-				break skipToDelim
-			case 0x00000080:
-				pos += 4
-				break skipToDelim
+			// Stopped at a line ending or past the end instead of a delimiter, found an
+			// empty name, or there is nothing after the delimiter
+			if pos >= end-1 || data[pos] == '\n' || pos == recordStart {
+				return nameError(data, recordStart, dialect)
+			}
+			name = data[recordStart:pos]
+		} else {
+			var err error
+			if name, pos, err = dialect.readName(data, pos, &scratch); err != nil {
+				return malformedAt(recordStart, err)
+			}
+			if pos+delimiterLen >= end {
+				return nameError(data, recordStart, dialect)
 			}
-			pos += 8
 		}
-		name := data[recordStart:pos]
-		id := IdentityHash(xxhash.Sum64(name))
-		pos++
-		// Read measurement
-		negativizer := int16(0)
-		if data[pos] == '-' {
-			pos += 1
-			negativizer = -1
+		pos += delimiterLen
+		measurement, next, ok := lookupMeasurement(data, pos, numberLookup)
+		if !ok {
+			var err error
+			if measurement, next, err = ParseDecimal1At(data, pos); err != nil {
+				return malformedAt(recordStart, err)
+			}
 		}
-		foldedLookup := fold((*uint32)(unsafe.Pointer(&data[pos])))
-		item, newItem := results.get(id)
-		num := numberLookup[foldedLookup]
-		recordMeasurement := num&0x3ff | negativizer
-		pos += int(num >> 10)
-		// Update map
-		if newItem != nil {
-			newItem.Name = string(name)
-			newItem.Id = id
-			newItem.Min = recordMeasurement
-			newItem.Max = recordMeasurement
-			newItem.Sum = Decimal1_64(recordMeasurement)
-			newItem.Count = 1
-		} else {
-			item.Update(recordMeasurement)
+		var item, newItem *stationEntry
+		if known != nil {
+			item, newItem = known.get(name)
 		}
+		if item == nil && newItem == nil {
+			id := IdentityHash(xxhash.Sum64(name))
+			if item, newItem = results.get(id); newItem != nil {
+				if err := results.setName(newItem, name); err != nil {
+					return err
+				}
+				newItem.Id = id
+			}
+		}
+		addMeasurement(item, newItem, measurement, thresholds)
+		pos = next
+	}
+	return nil
+}
+
+// The measurement at pos and the position after its line ending, if the lookup covers
+// it. Inlined into the parse loops, which call ParseDecimal1At when it does not.
+func lookupMeasurement(data []byte, pos int, numberLookup *[65536]decimal1Entry) (measurement Decimal1_16, next int, ok bool) {
+	negative := Decimal1_16(0)
+	if data[pos] == '-' {
+		negative = 1
 	}
+	// Not &data[pos+1]: a lone '-' may be the last byte of data, and the padding after it
+	// is readable
+	word := *(*uint32)(unsafe.Add(unsafe.Pointer(&data[pos]), negative))
+	// fold(word), spelled out to keep this within the inlining budget
+	entry := numberLookup[uint16(word^word>>12)]
+	next = pos + int(negative+entry.num>>10)
+	// Two's complement negate when negative is 1, no-op when 0. Other words fold to the
+	// key of a known one, "1n2" to that of "1.2", so the entry's half must match. A zero
+	// entry, a shape the lookup does not know, leaves next-1 on the delimiter or the '-'.
+	return (entry.num&0x3ff ^ -negative) + negative, next, entry.high == uint16(word>>16) && next <= len(data) && data[next-1] == '\n'
 }
 
-func PrepareDecimal1Lookup() [65536]Decimal1_16 {
-	v := [65536]Decimal1_16{}
+// Counts measurement in item, or in newItem for a station seen for the first time.
+func addMeasurement(item, newItem *stationEntry, measurement Decimal1_16, thresholds *Thresholds) {
+	if newItem != nil {
+		newItem.Min, newItem.Max = measurement, measurement
+		item = newItem
+	}
+	item.Update(measurement, thresholds)
+}
+
+// The top half of a measurement's first four bytes, which together with their fold tells
+// them apart from any other four bytes, and its value with, in the top bits, its length
+// including the line ending.
+type decimal1Entry struct {
+	high uint16
+	num  Decimal1_16
+}
+
+// Maps the folded first four bytes of a measurement to its entry.
+func PrepareDecimal1Lookup(lineEnding string) [65536]decimal1Entry {
+	v := [65536]decimal1Entry{}
 	for i := range 1000 {
-		s := fmt.Sprintf("%d.%d\n", i/10, i%10)
+		s := fmt.Sprintf("%d.%d%s", i/10, i%10, lineEnding)
 		b := []byte(s)
-		foldedLookup := fold((*uint32)(unsafe.Pointer(&b[0])))
+		word := *(*uint32)(unsafe.Pointer(&b[0]))
 		skip := int16(len(s) << 10)
-		v[foldedLookup] = Decimal1_16(i) | skip
+		v[fold(word)] = decimal1Entry{high: uint16(word >> 16), num: Decimal1_16(i) | skip}
 	}
 	return v
 }
 
-func fold(val *uint32) uint16 {
-	v := *val & 0x0f0f0f0f
-	return uint16(v) | uint16(v>>12)
+// Distinct for the first four bytes of every "d.d" and "dd.d" with either line ending.
+func fold(word uint32) uint16 {
+	return uint16(word ^ word>>12)
 }
 
 func Decimal1_64ToFloat(dec Decimal1_64) float64 {
@@ -181,3 +304,16 @@ func Decimal1_64ToFloat(dec Decimal1_64) float64 {
 func Decimal1_16ToFloat(dec Decimal1_16) float64 {
 	return float64(dec) / 10
 }
+
+// Parses a decimal like "-12.3" into tenths, rounding any further digits.
+func ParseDecimal1(s string) (Decimal1_16, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	f = math.Round(f * 10)
+	if f < math.MinInt16 || f > math.MaxInt16 {
+		return 0, fmt.Errorf("decimal out of range: %s", s)
+	}
+	return Decimal1_16(f), nil
+}
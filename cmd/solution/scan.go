@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+// How the parser finds delimiters and line ends.
+type ScanMode int
+
+const (
+	// Eight bytes at a time in general purpose registers, see detectDelimiterOrNewline
+	ScanSWAR ScanMode = iota
+	// 64 bytes at a time into delimiter and newline bitmasks, two 32 byte compares each
+	ScanAVX2
+	// 64 bytes at a time into mask registers
+	ScanAVX512
+	// arm64: 64 bytes at a time, four 16 byte compares folded into a mask by pairwise
+	// adds, and measurements decoded eight at a time
+	ScanNEON
+)
+
+func (m ScanMode) String() string {
+	return [...]string{"swar", "avx2", "avx512", "neon"}[m]
+}
+
+func ParseScanMode(s string) (ScanMode, error) {
+	var mode ScanMode
+	switch s {
+	case "swar":
+		return ScanSWAR, nil
+	case "avx2":
+		mode = ScanAVX2
+	case "avx512":
+		mode = ScanAVX512
+	case "neon":
+		mode = ScanNEON
+	default:
+		return ScanSWAR, fmt.Errorf("unknown scan mode %q, expected swar, avx2, avx512 or neon", s)
+	}
+	if scanKernelFor(mode) == nil {
+		return ScanSWAR, fmt.Errorf("scan mode %s is not supported on this CPU", s)
+	}
+	return mode, nil
+}
+
+// Sets bit i of delims[b] and newlines[b] when byte 64*b+i of data is delim or '\n',
+// for blocks blocks of 64 bytes.
+type scanKernel func(data *byte, blocks int, delim byte, delims *uint64, newlines *uint64)
+
+// Decodes the measurements of a batch of records at once. Each word holds the 8 bytes
+// that end with a measurement's last digit and is replaced by the lane that
+// decodedMeasurement reads.
+type measurementKernel func(words *[measurementBatch]uint64)
+
+// Records per measurementKernel call
+const measurementBatch = 8
+
+// The measurement of length bytes that a measurementKernel decoded into lane: the
+// absolute value of "dd.d" from bytes 4, 5 and 7 of the word in the low 16 bits, and in
+// bytes 3 to 7 the class of the word's byte in the same place, digit, minus or point.
+// The length, known from the delimiter and newline masks, says which bytes have to be
+// which. false for any other shape, which the slow path takes.
+func decodedMeasurement(lane uint64, length int) (Decimal1_16, bool) {
+	const digit, minus, point = 1, 2, 4
+	value := Decimal1_16(lane & 0xffff)
+	switch length {
+	case 3:
+		return value, lane>>40 == digit|point<<8|digit<<16
+	case 4:
+		classes := lane >> 32
+		if classes&0xff == minus {
+			value = -value
+		}
+		return value, classes>>8 == digit|point<<8|digit<<16 && (classes&0xff == digit || classes&0xff == minus)
+	case 5:
+		return -value, lane>>24 == minus|digit<<8|digit<<16|point<<24|digit<<32
+	}
+	return 0, false
+}
+
+// Bytes scanned per kernel call. Records crossing the end of a window are rescanned
+// as the start of the next one.
+const scanWindow = 4096
+
+// Index of the first set bit at or after from, or -1 if there is none in masks.
+func nextBit(masks []uint64, from int) int {
+	i := from >> 6
+	if i >= len(masks) {
+		return -1
+	}
+	m := masks[i] & (^uint64(0) << (from & 63))
+	for m == 0 {
+		i++
+		if i >= len(masks) {
+			return -1
+		}
+		m = masks[i]
+	}
+	return i<<6 + bits.TrailingZeros64(m)
+}
+
+// IterInto for the SIMD scan modes, with single byte delimiters without quoting. Each
+// window of input is turned into bitmasks first, then records are cut out of it with a
+// couple of bit scans each, so several short records come out of one 64 byte block.
+// Names are hashed like HashFused. Measurements go through the fold lookup, unless
+// the kernel comes with a measurementKernel, as NEON does, which decodes them a batch
+// at a time.
+//
+// Reads past a record stay within the mmapPadSize bytes of padding after the input:
+// hashing the last name word reads at most 7 bytes past the name, and the fold reads 4
+// bytes from the measurement start. The measurementKernel's words end at the line
+// ending, so they are read from within data. All are unaligned loads, which amd64 and
+// arm64 allow on normal memory.
+func IterMaskedInto(data []byte, results *ProcessedResults, known *KnownResults, numberLookup *[65536]decimal1Entry, thresholds *Thresholds, dialect *Dialect, kernel scanKernel, decode measurementKernel) error {
+	var delims, newlines [scanWindow / 64]uint64
+	// The block overlapping the end of data is scanned from a copy, so the kernel
+	// never reads past the input's padding
+	var tail [64]byte
+	delim := dialect.Delimiter[0]
+	pos := 0
+	end := len(data)
+	for pos < end {
+		windowStart := pos
+		n := min(end-pos, scanWindow)
+		blocks := n / 64
+		if blocks > 0 {
+			kernel(&data[pos], blocks, delim, &delims[0], &newlines[0])
+		}
+		if n%64 != 0 {
+			tail = [64]byte{}
+			copy(tail[:], data[pos+blocks*64:pos+n])
+			kernel(&tail[0], 1, delim, &delims[blocks], &newlines[blocks])
+			blocks++
+		}
+		windowDelims, windowNewlines := delims[:blocks], newlines[:blocks]
+		if decode != nil {
+			var err error
+			if pos, err = iterDecodedWindow(data, pos, windowStart, windowDelims, windowNewlines, results, known, thresholds, dialect, decode); err != nil {
+				return err
+			}
+		} else {
+			for pos < end {
+				eol := nextBit(windowNewlines, pos-windowStart)
+				if eol < 0 {
+					break
+				}
+				// The first delimiter has to be within the line, after a name and before a
+				// measurement
+				delimPos := nextBit(windowDelims, pos-windowStart)
+				if delimPos <= pos-windowStart || delimPos+1 >= eol {
+					return nameError(data, pos, dialect)
+				}
+				name := data[pos : windowStart+delimPos]
+				id := fusedHash(name)
+				// The newline is known already, so the next record does not wait for the lookup
+				measurement, _, ok := lookupMeasurement(data, windowStart+delimPos+1, numberLookup)
+				if !ok {
+					var err error
+					if measurement, _, err = ParseDecimal1At(data, windowStart+delimPos+1); err != nil {
+						return malformedAt(pos, err)
+					}
+				}
+				var item, newItem *stationEntry
+				if known != nil {
+					item, newItem = known.get(name)
+				}
+				if item == nil && newItem == nil {
+					if item, newItem = results.get(id); newItem != nil {
+						if err := results.setName(newItem, name); err != nil {
+							return err
+						}
+						newItem.Id = id
+					}
+				}
+				addMeasurement(item, newItem, measurement, thresholds)
+				pos = windowStart + eol + 1
+			}
+		}
+		if pos == windowStart {
+			// A record longer than the window, or an unterminated last one
+			if err := IterFusedInto(data[pos:], results, known, numberLookup, thresholds, dialect); err != nil {
+				return inChunk(err, int64(pos))
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// The records of a window for IterMaskedInto with a measurementKernel: a batch of them
+// is cut out first, then their measurements are decoded in one call and counted. Returns
+// the position after the last complete record in the window.
+func iterDecodedWindow(data []byte, pos, windowStart int, windowDelims, windowNewlines []uint64, results *ProcessedResults, known *KnownResults, thresholds *Thresholds, dialect *Dialect, decode measurementKernel) (int, error) {
+	var words [measurementBatch]uint64
+	var starts, delimiters, ends [measurementBatch]int
+	// The '\r' of "\r\n"
+	lineEndStart := len(dialect.LineEnding) - 1
+	for {
+		n := 0
+		var cutErr error
+		for ; n < measurementBatch; n++ {
+			// As in IterMaskedInto
+			eol := nextBit(windowNewlines, pos-windowStart)
+			if eol < 0 {
+				break
+			}
+			delimPos := nextBit(windowDelims, pos-windowStart)
+			if delimPos <= pos-windowStart || delimPos+1 >= eol {
+				// Reported once the records before it are counted
+				cutErr = nameError(data, pos, dialect)
+				break
+			}
+			starts[n], delimiters[n] = pos, windowStart+delimPos
+			ends[n] = windowStart + eol - lineEndStart
+			// The last digit is byte 7 whatever the length. The first record of data may
+			// not have 8 bytes before it, a zero word decodes as no measurement.
+			words[n] = 0
+			if ends[n] >= 8 {
+				words[n] = *(*uint64)(unsafe.Pointer(&data[ends[n]-8]))
+			}
+			pos = windowStart + eol + 1
+		}
+		decode(&words)
+		for i := range n {
+			name := data[starts[i]:delimiters[i]]
+			id := fusedHash(name)
+			measurement, ok := decodedMeasurement(words[i], ends[i]-delimiters[i]-1)
+			if !ok || data[ends[i]] != dialect.LineEnding[0] {
+				var err error
+				if measurement, _, err = ParseDecimal1At(data, delimiters[i]+1); err != nil {
+					return pos, malformedAt(starts[i], err)
+				}
+			}
+			var item, newItem *stationEntry
+			if known != nil {
+				item, newItem = known.get(name)
+			}
+			if item == nil && newItem == nil {
+				if item, newItem = results.get(id); newItem != nil {
+					if err := results.setName(newItem, name); err != nil {
+						return pos, err
+					}
+					newItem.Id = id
+				}
+			}
+			addMeasurement(item, newItem, measurement, thresholds)
+		}
+		if cutErr != nil || n < measurementBatch {
+			return pos, cutErr
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+//go:noescape
+func scanBlocksAVX2(data *byte, blocks int, delim byte, delims *uint64, newlines *uint64)
+
+//go:noescape
+func scanBlocksAVX512(data *byte, blocks int, delim byte, delims *uint64, newlines *uint64)
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+var hasAVX2, hasAVX512BW = detectAVX()
+
+// The CPU must support the instructions and the OS must save the wider registers on
+// context switches, per XCR0.
+func detectAVX() (bool, bool) {
+	maxLeaf, _, _, _ := cpuid(0, 0)
+	if maxLeaf < 7 {
+		return false, false
+	}
+	_, _, ecx1, _ := cpuid(1, 0)
+	const osxsave = 1 << 27
+	if ecx1&osxsave == 0 {
+		return false, false
+	}
+	xcr0, _ := xgetbv()
+	const (
+		ymmState = 0x6
+		zmmState = 0xe0
+		avx2     = 1 << 5
+		avx512f  = 1 << 16
+		avx512bw = 1 << 30
+	)
+	_, ebx7, _, _ := cpuid(7, 0)
+	withAVX2 := xcr0&ymmState == ymmState && ebx7&avx2 != 0
+	withAVX512 := withAVX2 && xcr0&zmmState == zmmState && ebx7&avx512f != 0 && ebx7&avx512bw != 0
+	return withAVX2, withAVX512
+}
+
+// nil if mode has no kernel on this CPU.
+func scanKernelFor(mode ScanMode) scanKernel {
+	switch {
+	case mode == ScanAVX2 && hasAVX2:
+		return scanBlocksAVX2
+	case mode == ScanAVX512 && hasAVX512BW:
+		return scanBlocksAVX512
+	}
+	return nil
+}
+
+// The lookup decodes measurements on amd64, there is no measurementKernel.
+func measurementKernelFor(mode ScanMode) measurementKernel {
+	return nil
+}
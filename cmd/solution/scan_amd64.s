@@ -0,0 +1,91 @@
+#include "textflag.h"
+
+// func scanBlocksAVX2(data *byte, blocks int, delim byte, delims *uint64, newlines *uint64)
+TEXT ·scanBlocksAVX2(SB), NOSPLIT, $0-40
+	MOVQ data+0(FP), SI
+	MOVQ blocks+8(FP), CX
+	MOVBLZX delim+16(FP), AX
+	MOVQ delims+24(FP), DI
+	MOVQ newlines+32(FP), DX
+	MOVD AX, X1
+	VPBROADCASTB X1, Y1
+	MOVL $0x0a, AX
+	MOVD AX, X2
+	VPBROADCASTB X2, Y2
+	TESTQ CX, CX
+	JZ avx2done
+
+avx2loop:
+	VMOVDQU 0(SI), Y3
+	VMOVDQU 32(SI), Y4
+	VPCMPEQB Y1, Y3, Y5
+	VPCMPEQB Y1, Y4, Y6
+	VPMOVMSKB Y5, R8
+	VPMOVMSKB Y6, R9
+	SHLQ $32, R9
+	ORQ R9, R8
+	MOVQ R8, 0(DI)
+	VPCMPEQB Y2, Y3, Y5
+	VPCMPEQB Y2, Y4, Y6
+	VPMOVMSKB Y5, R8
+	VPMOVMSKB Y6, R9
+	SHLQ $32, R9
+	ORQ R9, R8
+	MOVQ R8, 0(DX)
+	ADDQ $64, SI
+	ADDQ $8, DI
+	ADDQ $8, DX
+	DECQ CX
+	JNZ avx2loop
+
+avx2done:
+	VZEROUPPER
+	RET
+
+// func scanBlocksAVX512(data *byte, blocks int, delim byte, delims *uint64, newlines *uint64)
+TEXT ·scanBlocksAVX512(SB), NOSPLIT, $0-40
+	MOVQ data+0(FP), SI
+	MOVQ blocks+8(FP), CX
+	MOVBLZX delim+16(FP), AX
+	MOVQ delims+24(FP), DI
+	MOVQ newlines+32(FP), DX
+	VPBROADCASTB AX, Z1
+	MOVL $0x0a, AX
+	VPBROADCASTB AX, Z2
+	TESTQ CX, CX
+	JZ avx512done
+
+avx512loop:
+	VMOVDQU8 0(SI), Z3
+	VPCMPEQB Z1, Z3, K1
+	VPCMPEQB Z2, Z3, K2
+	KMOVQ K1, 0(DI)
+	KMOVQ K2, 0(DX)
+	ADDQ $64, SI
+	ADDQ $8, DI
+	ADDQ $8, DX
+	DECQ CX
+	JNZ avx512loop
+
+avx512done:
+	VZEROUPPER
+	RET
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
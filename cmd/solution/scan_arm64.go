@@ -0,0 +1,24 @@
+package main
+
+//go:noescape
+func scanBlocksNEON(data *byte, blocks int, delim byte, delims *uint64, newlines *uint64)
+
+//go:noescape
+func decodeMeasurementsNEON(words *[measurementBatch]uint64)
+
+// Advanced SIMD is part of the arm64 baseline, so there is nothing to detect.
+func scanKernelFor(mode ScanMode) scanKernel {
+	if mode == ScanNEON {
+		return scanBlocksNEON
+	}
+	return nil
+}
+
+// With the NEON scan, measurements are decoded a batch at a time instead of through the
+// lookup.
+func measurementKernelFor(mode ScanMode) measurementKernel {
+	if mode == ScanNEON {
+		return decodeMeasurementsNEON
+	}
+	return nil
+}
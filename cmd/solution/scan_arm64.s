@@ -0,0 +1,134 @@
+#include "textflag.h"
+
+// NEON has no byte movemask. Compare results are ANDed with each byte's bit weight
+// within its group of eight, then three rounds of pairwise adds fold each group of
+// eight bytes into one mask byte.
+
+// func scanBlocksNEON(data *byte, blocks int, delim byte, delims *uint64, newlines *uint64)
+TEXT ·scanBlocksNEON(SB), NOSPLIT, $0-40
+	MOVD data+0(FP), R0
+	MOVD blocks+8(FP), R1
+	MOVBU delim+16(FP), R2
+	MOVD delims+24(FP), R3
+	MOVD newlines+32(FP), R4
+	VDUP R2, V20.B16
+	MOVD $0x0a, R5
+	VDUP R5, V21.B16
+	MOVD $0x8040201008040201, R5
+	VMOV R5, V22.D[0]
+	VMOV R5, V22.D[1]
+	CBZ R1, done
+
+loop:
+	VLD1.P 64(R0), [V0.B16, V1.B16, V2.B16, V3.B16]
+
+	VCMEQ V0.B16, V20.B16, V4.B16
+	VCMEQ V1.B16, V20.B16, V5.B16
+	VCMEQ V2.B16, V20.B16, V6.B16
+	VCMEQ V3.B16, V20.B16, V7.B16
+	VAND V22.B16, V4.B16, V4.B16
+	VAND V22.B16, V5.B16, V5.B16
+	VAND V22.B16, V6.B16, V6.B16
+	VAND V22.B16, V7.B16, V7.B16
+	VADDP V5.B16, V4.B16, V8.B16
+	VADDP V7.B16, V6.B16, V9.B16
+	VADDP V9.B16, V8.B16, V8.B16
+	VADDP V8.B16, V8.B16, V8.B16
+	VMOV V8.D[0], R6
+	MOVD.P R6, 8(R3)
+
+	VCMEQ V0.B16, V21.B16, V4.B16
+	VCMEQ V1.B16, V21.B16, V5.B16
+	VCMEQ V2.B16, V21.B16, V6.B16
+	VCMEQ V3.B16, V21.B16, V7.B16
+	VAND V22.B16, V4.B16, V4.B16
+	VAND V22.B16, V5.B16, V5.B16
+	VAND V22.B16, V6.B16, V6.B16
+	VAND V22.B16, V7.B16, V7.B16
+	VADDP V5.B16, V4.B16, V8.B16
+	VADDP V7.B16, V6.B16, V9.B16
+	VADDP V9.B16, V8.B16, V8.B16
+	VADDP V8.B16, V8.B16, V8.B16
+	VMOV V8.D[0], R6
+	MOVD.P R6, 8(R4)
+
+	SUBS $1, R1, R1
+	BNE loop
+
+done:
+	RET
+
+// Each word ends with a measurement's last digit, so a "dd.d" is always bytes 4 to 7
+// and the sign at most byte 3; the caller checks the classes against the length.
+
+// Decodes the two words in V. V4 becomes the bytes minus '0' and V5 a mask of the
+// digits among them; the digit, minus and point masks are ANDed with their class bits
+// in bytes 3 to 7 and ORed into V8. Tens, units and tenths, bytes 4, 5 and 7, are
+// combined with shifts and adds for the multiplications by 10: 10*tens+units within a
+// byte, then in 16 bits with the tenths, and the sum is moved to the bottom of the lane,
+// where V8 has no class bits.
+#define DECODE(V) \
+	VSUB V16.B16, V.B16, V4.B16; \
+	VUMIN V17.B16, V4.B16, V5.B16; \
+	VCMEQ V4.B16, V5.B16, V5.B16; \
+	VCMEQ V18.B16, V.B16, V6.B16; \
+	VCMEQ V19.B16, V.B16, V7.B16; \
+	VAND V20.B16, V5.B16, V8.B16; \
+	VAND V21.B16, V6.B16, V6.B16; \
+	VAND V22.B16, V7.B16, V7.B16; \
+	VORR V6.B16, V8.B16, V8.B16; \
+	VORR V7.B16, V8.B16, V8.B16; \
+	VAND V5.B16, V4.B16, V4.B16; \
+	VAND V23.B16, V4.B16, V4.B16; \
+	VSHL $3, V4.B16, V5.B16; \
+	VSHL $1, V4.B16, V6.B16; \
+	VADD V6.B16, V5.B16, V5.B16; \
+	VSHL $8, V5.D2, V5.D2; \
+	VADD V5.B16, V4.B16, V4.B16; \
+	VAND V24.B16, V4.B16, V4.B16; \
+	VUSHR $8, V4.H8, V4.H8; \
+	VSHL $3, V4.H8, V5.H8; \
+	VSHL $1, V4.H8, V6.H8; \
+	VADD V6.H8, V5.H8, V5.H8; \
+	VSHL $16, V5.D2, V5.D2; \
+	VADD V5.H8, V4.H8, V4.H8; \
+	VUSHR $48, V4.D2, V4.D2; \
+	VORR V8.B16, V4.B16, V.B16
+
+// func decodeMeasurementsNEON(words *[measurementBatch]uint64)
+TEXT ·decodeMeasurementsNEON(SB), NOSPLIT, $0-8
+	MOVD words+0(FP), R0
+	MOVD $0x30, R1
+	VDUP R1, V16.B16
+	MOVD $9, R1
+	VDUP R1, V17.B16
+	MOVD $0x2d, R1
+	VDUP R1, V18.B16
+	MOVD $0x2e, R1
+	VDUP R1, V19.B16
+	// Class bits of bytes 3 to 7: 1 for a digit, 2 for '-', 4 for '.'
+	MOVD $0x0101010101000000, R1
+	VMOV R1, V20.D[0]
+	VMOV R1, V20.D[1]
+	MOVD $0x0202020202000000, R1
+	VMOV R1, V21.D[0]
+	VMOV R1, V21.D[1]
+	MOVD $0x0404040404000000, R1
+	VMOV R1, V22.D[0]
+	VMOV R1, V22.D[1]
+	// Tens, units and tenths of "dd.d"
+	MOVD $0xff00ffff00000000, R1
+	VMOV R1, V23.D[0]
+	VMOV R1, V23.D[1]
+	// 10*tens+units and tenths
+	MOVD $0xff00ff0000000000, R1
+	VMOV R1, V24.D[0]
+	VMOV R1, V24.D[1]
+
+	VLD1 (R0), [V0.B16, V1.B16, V2.B16, V3.B16]
+	DECODE(V0)
+	DECODE(V1)
+	DECODE(V2)
+	DECODE(V3)
+	VST1 [V0.B16, V1.B16, V2.B16, V3.B16], (R0)
+	RET
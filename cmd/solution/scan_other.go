@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+
+package main
+
+// No SIMD kernels outside amd64 and arm64, everything uses the SWAR scanner.
+func scanKernelFor(mode ScanMode) scanKernel {
+	return nil
+}
+
+func measurementKernelFor(mode ScanMode) measurementKernel {
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Station names of 1 to 40 bytes, including multi-byte UTF-8 and names that share
+// prefixes, so both the short and long name paths of every scanner are used.
+func testStations(rng *rand.Rand, count int) []string {
+	letters := []string{"a", "b", "z", "A", " ", "-", ".", "é", "ü", "ß", "北", "京"}
+	stations := make([]string, 0, count)
+	for len(stations) < count {
+		var name string
+		for n := 1 + rng.IntN(40); len(name) < n; {
+			name += letters[rng.IntN(len(letters))]
+		}
+		stations = append(stations, name)
+		if len(stations) < count && len(name) > 8 {
+			stations = append(stations, name[:len(name)/2])
+		}
+	}
+	return stations
+}
+
+// Mostly measurements the lookup covers, with every sign and digit count, plus now
+// and then one that only the slow path understands.
+func testMeasurement(rng *rand.Rand) string {
+	if rng.IntN(40) == 0 {
+		return [...]string{"5", "-7", "100.5", "-123.4", "0"}[rng.IntN(5)]
+	}
+	tenths := rng.IntN(1999) - 999
+	sign := ""
+	if tenths < 0 {
+		sign, tenths = "-", -tenths
+	}
+	return fmt.Sprintf("%s%d.%d", sign, tenths/10, tenths%10)
+}
+
+// Records for rows readings and the stats they should add up to.
+func testInput(rng *rand.Rand, stations []string, rows int, lineEnding string) ([]byte, map[string]WeatherStationData) {
+	var data bytes.Buffer
+	want := map[string]WeatherStationData{}
+	for range rows {
+		name := stations[rng.IntN(len(stations))]
+		measurement := testMeasurement(rng)
+		fmt.Fprintf(&data, "%s;%s%s", name, measurement, lineEnding)
+		addReading(want, name, measurement)
+	}
+	return data.Bytes(), want
+}
+
+func addReading(want map[string]WeatherStationData, name, measurement string) {
+	value, err := strconv.ParseFloat(measurement, 64)
+	if err != nil {
+		panic(err)
+	}
+	tenths := Decimal1_16(math.Round(value * 10))
+	item, ok := want[name]
+	if !ok {
+		item = WeatherStationData{Name: name, Min: tenths, Max: tenths}
+	}
+	item.Count++
+	item.Sum += Decimal1_64(tenths)
+	item.Min, item.Max = min(item.Min, tenths), max(item.Max, tenths)
+	want[name] = item
+}
+
+// A copy of data followed by pad zero bytes and then a page that faults on any access,
+// like the end of NewMmapFile's mapping when the file ends on a page boundary and pad
+// is mmapPadSize. Reading further than the padding crashes the test.
+func guardedCopy(t *testing.T, data []byte, pad int) []byte {
+	pageSize := os.Getpagesize()
+	size := (len(data) + pad + pageSize - 1) &^ (pageSize - 1)
+	mapping, err := syscall.Mmap(-1, 0, size+pageSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Munmap(mapping) })
+	if err := syscall.Mprotect(mapping[size:], syscall.PROT_NONE); err != nil {
+		t.Fatal(err)
+	}
+	start := size - pad - len(data)
+	copy(mapping[start:], data)
+	return mapping[start : start+len(data)]
+}
+
+// Runs iter over data into a fresh table and returns the stations found.
+func parseStations(t *testing.T, iter iterFunc, data []byte, dialect *Dialect) map[string]WeatherStationData {
+	results := newTestResults(t)
+	defer results.Close()
+	lookup := PrepareDecimal1Lookup(dialect.LineEnding)
+	thresholds := NoThresholds()
+	if err := iter(data, results, nil, &lookup, &thresholds, dialect); err != nil {
+		t.Fatal(err)
+	}
+	return stationsOf(results)
+}
+
+func newTestResults(t *testing.T) *ProcessedResults {
+	results := new(ProcessedResults)
+	if err := results.names.init(-1); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+// The stations in results without their ids, which depend on the hash.
+func stationsOf(results *ProcessedResults) map[string]WeatherStationData {
+	stations := map[string]WeatherStationData{}
+	for item := range results.Entries() {
+		item.Id = 0
+		stations[item.Name] = *item
+	}
+	return stations
+}
+
+func compareStations(t *testing.T, got, want map[string]WeatherStationData) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %d stations, want %d", len(got), len(want))
+	}
+	for name, w := range want {
+		if g := got[name]; g != w {
+			t.Errorf("station %q: got %+v, want %+v", name, g, w)
+		}
+	}
+}
+
+type testParser struct {
+	name string
+	iter iterFunc
+}
+
+// The fused scanner and each SIMD kernel this machine supports.
+func fastParsers(t *testing.T) []testParser {
+	parsers := []testParser{{"fused", IterFusedInto}}
+	for _, mode := range []ScanMode{ScanAVX2, ScanAVX512, ScanNEON} {
+		if scanKernelFor(mode) == nil {
+			t.Logf("SCAN=%s is not supported here, skipped", mode)
+			continue
+		}
+		options := ParseOptions{Scan: mode}
+		parsers = append(parsers, testParser{mode.String(), options.Iter()})
+	}
+	return parsers
+}
+
+// The fused and SIMD scanners against IterInto, and IterInto against the generated
+// stats, on inputs whose last record ends at many offsets within a 64 byte block and
+// right before the padding, with and without a final line ending.
+func TestScannersMatchIterInto(t *testing.T) {
+	parsers := fastParsers(t)
+	rng := rand.New(rand.NewPCG(1, 2))
+	stations := testStations(rng, 60)
+	for _, lineEnding := range []string{"\n", "\r\n"} {
+		dialect, err := NewDialect(";", lineEnding, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for round := range 200 {
+			// Up to a few windows of scanWindow bytes
+			data, want := testInput(rng, stations, 1+rng.IntN(600), lineEnding)
+			if round%2 == 1 {
+				data = data[:len(data)-len(lineEnding)]
+			}
+			// Beyond mmapPadSize, up to 3 more bytes so that the tail ends at different
+			// distances from the guard page
+			for extra := range 4 {
+				name := fmt.Sprintf("%q/round %d/%d bytes/pad %d", lineEnding, round, len(data), mmapPadSize+extra)
+				t.Run(name, func(t *testing.T) {
+					input := guardedCopy(t, data, mmapPadSize+extra)
+					reference := parseStations(t, IterInto, input, dialect)
+					t.Run("xxhash", func(t *testing.T) {
+						compareStations(t, reference, want)
+					})
+					for _, p := range parsers {
+						t.Run(p.name, func(t *testing.T) {
+							compareStations(t, parseStations(t, p.iter, input, dialect), reference)
+						})
+					}
+				})
+			}
+		}
+	}
+}
+
+// Each measurementKernel this machine has against ParseDecimal1At, for every value the
+// lookup covers and for random bytes, with the delimiter right before the measurement as
+// the masks guarantee. A shape the kernel does not decode goes to the slow path, so it
+// only has to decode the covered ones, but must never get another one wrong.
+func TestMeasurementKernels(t *testing.T) {
+	type measurement struct {
+		text    string
+		covered bool
+	}
+	var measurements []measurement
+	for tenths := -999; tenths <= 999; tenths++ {
+		measurements = append(measurements, measurement{fmt.Sprintf("%.1f", float64(tenths)/10), true})
+	}
+	rng := rand.New(rand.NewPCG(9, 10))
+	letters := "0123456789-.;a\r\n"
+	for range 100000 {
+		text := make([]byte, 3+rng.IntN(3))
+		for i := range text {
+			text[i] = letters[rng.IntN(len(letters))]
+		}
+		measurements = append(measurements, measurement{text: string(text)})
+	}
+	for _, mode := range []ScanMode{ScanAVX2, ScanAVX512, ScanNEON} {
+		decode := measurementKernelFor(mode)
+		if decode == nil {
+			t.Logf("SCAN=%s decodes no measurements here, skipped", mode)
+			continue
+		}
+		t.Run(mode.String(), func(t *testing.T) {
+			for start := 0; start < len(measurements); start += measurementBatch {
+				batch := measurements[start:min(start+measurementBatch, len(measurements))]
+				var words [measurementBatch]uint64
+				for i, m := range batch {
+					// The end of a name, the delimiter and the measurement
+					words[i] = binary.LittleEndian.Uint64([]byte(strings.Repeat("7", 7-len(m.text)) + ";" + m.text))
+				}
+				decode(&words)
+				for i, m := range batch {
+					got, ok := decodedMeasurement(words[i], len(m.text))
+					want, next, err := ParseDecimal1At([]byte(m.text+"\n"), 0)
+					switch {
+					case ok && (err != nil || next != len(m.text)+1 || got != want):
+						t.Errorf("%q: decoded as %d, ParseDecimal1At gives %d, %d, %v", m.text, got, want, next, err)
+					case !ok && m.covered:
+						t.Errorf("%q: not decoded", m.text)
+					}
+				}
+			}
+		})
+	}
+}
+
+// A full name arena fails parsing and merging with a NameArenaFullError, rather than a
+// panic or a malformed input error.
+func TestNameArenaFull(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	data, _ := testInput(rng, testStations(rng, 60), 200, "\n")
+	input := guardedCopy(t, data, mmapPadSize)
+	dialect := DefaultDialect()
+	lookup := PrepareDecimal1Lookup(dialect.LineEnding)
+	thresholds := NoThresholds()
+	// Room for a few names only
+	shrink := func(results *ProcessedResults) {
+		results.names.data = results.names.data[:64]
+	}
+	for _, p := range append([]testParser{{"xxhash", IterInto}}, fastParsers(t)...) {
+		t.Run(p.name, func(t *testing.T) {
+			results := newTestResults(t)
+			defer results.Close()
+			shrink(results)
+			err := p.iter(input, results, nil, &lookup, &thresholds, dialect)
+			if full := (*NameArenaFullError)(nil); !errors.As(err, &full) {
+				t.Fatalf("got %v, want a NameArenaFullError", err)
+			}
+		})
+	}
+	t.Run("merge", func(t *testing.T) {
+		all := newTestResults(t)
+		defer all.Close()
+		if err := IterInto(input, all, nil, &lookup, &thresholds, dialect); err != nil {
+			t.Fatal(err)
+		}
+		into := newTestResults(t)
+		defer into.Close()
+		shrink(into)
+		if full := (*NameArenaFullError)(nil); !errors.As(into.MergeFrom(all), &full) {
+			t.Fatal("merging did not fail with a NameArenaFullError")
+		}
+	})
+}
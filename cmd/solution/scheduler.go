@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const DefaultChunkSize = 4 << 20
+
+type ScheduleOptions struct {
+	Workers   int
+	ChunkSize int
+	// Worker i is pinned to CPUs[i % len(CPUs)]. Empty leaves placement to the Go scheduler.
+	CPUs []int
+	// NUMA nodes in use, restricted to the CPUs above. Empty when not NUMA aware.
+	Nodes []NumaNode
+	// Where each worker's result table lives
+	Alloc AllocMode
+}
+
+func DefaultScheduleOptions() ScheduleOptions {
+	return ScheduleOptions{Workers: runtime.NumCPU(), ChunkSize: DefaultChunkSize}
+}
+
+// Hands out newline-aligned chunks of data to whichever worker asks first, so a slow
+// core only delays the chunks it is working on rather than a fixed share of the input.
+// The input may be split into regions, e.g. one per NUMA node; workers drain their home
+// region before helping with the others.
+type ChunkScheduler struct {
+	data []byte
+	// File offset of data
+	offset    int64
+	chunkSize int
+	regions   []chunkRegion
+}
+
+type chunkRegion struct {
+	Start, End int
+	cursor     atomic.Int64
+	// Keep cursors contended by different nodes on separate cache lines
+	_ [40]byte
+}
+
+func NewChunkScheduler(data []byte, offset int64, chunkSize int) *ChunkScheduler {
+	return NewRegionChunkScheduler(data, offset, chunkSize, []int{1})
+}
+
+// Splits data into one region per weight, sized proportionally. chunkSize is capped at
+// the size of data, so that advancing the cursors past the end cannot overflow.
+func NewRegionChunkScheduler(data []byte, offset int64, chunkSize int, weights []int) *ChunkScheduler {
+	chunkSize = min(max(chunkSize, 1), max(len(data), 1))
+	s := &ChunkScheduler{data: data, offset: offset, chunkSize: chunkSize, regions: make([]chunkRegion, len(weights))}
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	start, cumulative := 0, 0
+	for i, w := range weights {
+		cumulative += w
+		end := s.recordStart(int(int64(len(data)) * int64(cumulative) / int64(max(total, 1))))
+		s.regions[i].Start, s.regions[i].End = start, max(start, end)
+		s.regions[i].cursor.Store(int64(start))
+		start = s.regions[i].End
+	}
+	return s
+}
+
+func (s *ChunkScheduler) Regions() []chunkRegion {
+	return s.regions
+}
+
+// Claims the next chunk, from the home region if any is left, and returns its file
+// offset. Nominal chunk [start, start+chunkSize) is widened to the records starting in
+// it, so chunks are disjoint and cover all records.
+func (s *ChunkScheduler) Next(home int) (int64, []byte, bool) {
+	for i := range s.regions {
+		region := &s.regions[(home+i)%len(s.regions)]
+		start := int(region.cursor.Add(int64(s.chunkSize))) - s.chunkSize
+		if start >= region.End {
+			continue
+		}
+		end := min(start+s.chunkSize, region.End)
+		start = s.recordStart(start)
+		return s.offset + int64(start), s.data[start:s.recordStart(end)], true
+	}
+	return 0, nil, false
+}
+
+func (s *ChunkScheduler) Chunks(home int) iter.Seq2[int64, []byte] {
+	return func(yield func(int64, []byte) bool) {
+		for {
+			offset, chunk, ok := s.Next(home)
+			if !ok || !yield(offset, chunk) {
+				return
+			}
+		}
+	}
+}
+
+// Start of the first record beginning at or after pos.
+func (s *ChunkScheduler) recordStart(pos int) int {
+	if pos == 0 || pos >= len(s.data) {
+		return pos
+	}
+	eol := bytes.IndexByte(s.data[pos-1:], '\n')
+	if eol < 0 {
+		return len(s.data)
+	}
+	return pos + eol
+}
+
+// Parses a byte count like "512", "64K", "4M" or "1G".
+func ParseSize(s string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	suffix := ""
+	if multiplier != 1 {
+		s, suffix = s[:len(s)-1], s[len(s)-1:]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt/multiplier || n < math.MinInt/multiplier {
+		return 0, fmt.Errorf("size %s%s out of range", s, suffix)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Chunks from one or more regions, of any chunk size up to math.MaxInt, cover every
+// record once, in order, at the right offsets.
+func TestChunkSchedulerCoversInput(t *testing.T) {
+	var data bytes.Buffer
+	for i := range 1000 {
+		fmt.Fprintf(&data, "station %d;%d.%d\n", i, i%100, i%10)
+	}
+	const fileOffset = 100
+	for _, chunkSize := range []int{0, 1, 7, 4096, data.Len(), math.MaxInt} {
+		for _, weights := range [][]int{{1}, {1, 1}, {3, 1, 2}} {
+			t.Run(fmt.Sprintf("%d/%v", chunkSize, weights), func(t *testing.T) {
+				s := NewRegionChunkScheduler(data.Bytes(), fileOffset, chunkSize, weights)
+				var got bytes.Buffer
+				for offset, chunk := range s.Chunks(0) {
+					if want := int64(fileOffset + got.Len()); offset != want {
+						t.Fatalf("chunk at %d, want %d", offset, want)
+					}
+					if len(chunk) > 0 && chunk[len(chunk)-1] != '\n' {
+						t.Fatalf("chunk at %d ends within a record", offset)
+					}
+					got.Write(chunk)
+				}
+				if !bytes.Equal(got.Bytes(), data.Bytes()) {
+					t.Errorf("chunks add up to %d bytes, not the %d of the input", got.Len(), data.Len())
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"syscall"
+)
+
+// Streams the file with large sequential preads into a ring of buffers, handing each
+// filled buffer to a worker. Unlike MAP_POPULATE, parsing starts as soon as the first
+// block is in, so cold cache runs overlap disk reads with compute.
+type StreamReader struct {
+	file      *os.File
+	blockSize int
+	skipFirst bool
+	buffers   [][]byte
+	free      chan []byte
+	filled    chan streamBlock
+	err       error
+	running   bool
+}
+
+type streamBlock struct {
+	buf  []byte
+	data []byte
+	// File offset of data
+	offset int64
+}
+
+// Room in front of each block for the partial record carried over from the previous
+// block. Records longer than this are rejected.
+const streamCarrySize = 64 << 10
+
+// Bytes after each block that the parser may read past the last record
+const streamPadSize = 64
+
+// direct opens the file with O_DIRECT, bypassing the page cache; blockSize must then be
+// a multiple of the device's logical block size, which 4K is for any common device.
+func NewStreamReader(filename string, blockSize int, buffers int, direct bool, skipFirstLine bool) (*StreamReader, error) {
+	flags := os.O_RDONLY
+	if direct {
+		flags |= syscall.O_DIRECT
+		blockSize = (blockSize + 4095) &^ 4095
+	}
+	f, err := os.OpenFile(filename, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &StreamReader{
+		file:      f,
+		blockSize: blockSize,
+		skipFirst: skipFirstLine,
+		free:      make(chan []byte, buffers),
+		filled:    make(chan streamBlock, buffers),
+	}
+	for range buffers {
+		// mmap for page alignment, which O_DIRECT needs
+		buf, err := syscall.Mmap(-1, 0, streamCarrySize+blockSize+streamPadSize,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.buffers = append(r.buffers, buf)
+		r.free <- buf
+	}
+	r.running = true
+	go r.run()
+	return r, nil
+}
+
+func (r *StreamReader) run() {
+	defer close(r.filled)
+	carry := make([]byte, 0, streamCarrySize)
+	offset := int64(0)
+	first := true
+	for {
+		buf := <-r.free
+		start := streamCarrySize - len(carry)
+		copy(buf[start:], carry)
+		chunkOffset := offset - int64(len(carry))
+		n, err := r.file.ReadAt(buf[streamCarrySize:streamCarrySize+r.blockSize], offset)
+		offset += int64(n)
+		eof := err == io.EOF
+		if err != nil && !eof {
+			r.err = err
+			return
+		}
+		chunk := buf[start : streamCarrySize+n]
+		if first && r.skipFirst {
+			if eol := bytes.IndexByte(chunk, '\n'); eol >= 0 {
+				chunk = chunk[eol+1:]
+				chunkOffset += int64(eol + 1)
+			} else if !eof {
+				r.err = fmt.Errorf("header line longer than %d bytes", r.blockSize)
+				return
+			}
+		}
+		first = false
+		carry = carry[:0]
+		if !eof {
+			cut := bytes.LastIndexByte(chunk, '\n') + 1
+			if len(chunk)-cut > streamCarrySize {
+				r.err = fmt.Errorf("record longer than %d bytes at offset %d", streamCarrySize, offset)
+				return
+			}
+			carry = append(carry, chunk[cut:]...)
+			chunk = chunk[:cut]
+		}
+		if len(chunk) > 0 {
+			r.filled <- streamBlock{buf: buf, data: chunk, offset: chunkOffset}
+		} else {
+			r.free <- buf
+		}
+		if eof {
+			return
+		}
+	}
+}
+
+// Each chunk's buffer goes back to the ring once the caller moves on to the next one.
+// All workers share one queue, so home is ignored.
+func (r *StreamReader) Chunks(home int) iter.Seq2[int64, []byte] {
+	return func(yield func(int64, []byte) bool) {
+		for block := range r.filled {
+			more := yield(block.offset, block.data)
+			r.free <- block.buf
+			if !more {
+				return
+			}
+		}
+	}
+}
+
+// Read error that ended the stream early, if any. Only valid once Chunks is exhausted.
+func (r *StreamReader) Err() error {
+	return r.err
+}
+
+func (r *StreamReader) Close() error {
+	if r.running {
+		// Workers that stopped early leave blocks behind. Let the reader run to the end
+		// so it is done with the buffers before they are unmapped.
+		for range r.Chunks(0) {
+		}
+		r.running = false
+	}
+	for _, buf := range r.buffers {
+		syscall.Munmap(buf)
+	}
+	r.buffers = nil
+	return r.file.Close()
+}
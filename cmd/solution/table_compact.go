@@ -0,0 +1,110 @@
+//go:build compact
+
+package main
+
+import (
+	"iter"
+	"syscall"
+	"unsafe"
+)
+
+// The stats alone, 1 MiB for the whole table, which fits in L2 on current server cores.
+// Name references live in a separate array that is only touched when a station is first
+// seen and at the end.
+type stationEntry = stationStats
+
+const MAP_SIZE = 32768
+
+type ProcessedResults struct {
+	items    [MAP_SIZE]stationStats
+	nameRefs [MAP_SIZE]nameRef
+	names    nameArena
+	// Where the table itself is mapped, nil on the Go heap
+	mapping []byte
+}
+
+const ProcessedResultsSize = int(unsafe.Sizeof(ProcessedResults{}))
+
+func (p *ProcessedResults) MergeFrom(q *ProcessedResults) error {
+	for i := range q.items {
+		if q.items[i].Count != 0 {
+			if err := p.add(&q.items[i], q.names.bytes(q.nameRefs[i])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Unmaps the name arena and, unless the table is on the Go heap, the table itself, so
+// p must not be used afterwards.
+func (p *ProcessedResults) Close() error {
+	p.names.release()
+	mapping := p.mapping
+	if mapping == nil {
+		return nil
+	}
+	p.mapping = nil
+	return syscall.Munmap(mapping)
+}
+
+// Records counted so far.
+func (p *ProcessedResults) Rows() int64 {
+	rows := int64(0)
+	for i := range p.items {
+		rows += int64(p.items[i].Count)
+	}
+	return rows
+}
+
+// Merges in an entry from elsewhere, named name.
+func (p *ProcessedResults) add(entry *stationStats, name []byte) error {
+	pItem, newItem := p.get(entry.Id)
+	if newItem != nil {
+		*newItem = *entry
+		return p.setName(newItem, name)
+	}
+	pItem.Merge(entry)
+	return nil
+}
+
+func (p *ProcessedResults) get(id IdentityHash) (*stationStats, *stationStats) {
+	index := uint16(id) >> 1
+	if p.items[index].Count == 0 {
+		return nil, &p.items[index]
+	}
+	for {
+		if p.items[index].Id == id {
+			return &p.items[index], nil
+		}
+		index = index + 1
+		if p.items[index].Count == 0 {
+			break
+		}
+	}
+	return nil, &p.items[index]
+}
+
+// Names the entry that get just handed out as new.
+func (p *ProcessedResults) setName(entry *stationStats, name []byte) error {
+	index := (uintptr(unsafe.Pointer(entry)) - uintptr(unsafe.Pointer(&p.items[0]))) / unsafe.Sizeof(stationStats{})
+	var err error
+	p.nameRefs[index], err = p.names.add(name)
+	return err
+}
+
+// Entries are assembled on the fly, so the pointers are only valid until the next one.
+func (p *ProcessedResults) Entries() iter.Seq[*WeatherStationData] {
+	return func(yield func(*WeatherStationData) bool) {
+		var item WeatherStationData
+		for i := range p.items {
+			if p.items[i].Empty() {
+				continue
+			}
+			item = p.items[i].withName(p.names.String(p.nameRefs[i]))
+			if !yield(&item) {
+				return
+			}
+		}
+	}
+}
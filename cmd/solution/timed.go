@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Extended dialect: "name;timestamp;temp\n", where timestamp is either epoch seconds
+// or ISO-8601 (RFC 3339, zone optional and defaulting to UTC). Readings are aggregated
+// per (station, time bucket).
+
+type TimeWindow int
+
+const (
+	WindowHour TimeWindow = iota
+	WindowDay
+	WindowMonth
+)
+
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	switch s {
+	case "hour":
+		return WindowHour, nil
+	case "day":
+		return WindowDay, nil
+	case "month":
+		return WindowMonth, nil
+	}
+	return 0, fmt.Errorf("unknown time window %q, expected hour, day or month", s)
+}
+
+// Returns the unix time of the start of the bucket containing epoch.
+func (w TimeWindow) BucketStart(epoch int64) int64 {
+	switch w {
+	case WindowHour:
+		return floorDiv(epoch, 3600) * 3600
+	case WindowDay:
+		return floorDiv(epoch, 86400) * 86400
+	}
+	t := time.Unix(epoch, 0).UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+}
+
+func (w TimeWindow) Format(bucketStart int64) string {
+	t := time.Unix(bucketStart, 0).UTC()
+	switch w {
+	case WindowHour:
+		return t.Format("2006-01-02T15:00")
+	case WindowDay:
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01")
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+type TimedKey struct {
+	Id     IdentityHash
+	Bucket int64
+}
+
+// Bucket cardinality is unbounded, so unlike ProcessedResults this is a plain map.
+type TimedResults map[TimedKey]*WeatherStationData
+
+func (p TimedResults) MergeFrom(q TimedResults) error {
+	for key, qItem := range q {
+		if pItem, ok := p[key]; ok {
+			pItem.Merge(qItem)
+		} else {
+			p[key] = qItem
+		}
+	}
+	return nil
+}
+
+type TimedEntry struct {
+	Bucket int64
+	*WeatherStationData
+}
+
+// Entries sorted by station name, then bucket.
+func (p TimedResults) Sorted() []TimedEntry {
+	entries := make([]TimedEntry, 0, len(p))
+	for key, item := range p {
+		entries = append(entries, TimedEntry{key.Bucket, item})
+	}
+	slices.SortFunc(entries, func(a, b TimedEntry) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Bucket, b.Bucket)
+	})
+	return entries
+}
+
+func ParseTimestamp(s []byte) (int64, error) {
+	epoch, isEpoch := int64(0), len(s) > 0
+	negative := len(s) > 0 && s[0] == '-'
+	digits := s
+	if negative {
+		digits = s[1:]
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			isEpoch = false
+			break
+		}
+		epoch = epoch*10 + int64(c-'0')
+	}
+	if isEpoch && len(digits) > 0 {
+		if negative {
+			epoch = -epoch
+		}
+		return epoch, nil
+	}
+	str := unsafe.String(unsafe.SliceData(s), len(s))
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse("2006-01-02T15:04:05", str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return t.Unix(), nil
+}
+
+func IterTimedInto(data []byte, results TimedResults, numberLookup *[65536]decimal1Entry, thresholds *Thresholds, dialect *Dialect, window TimeWindow) error {
+	var scratch []byte
+	pos := 0
+	end := len(data)
+	for pos < end {
+		// Read name
+		recordStart := pos
+		name, next, err := dialect.readName(data, pos, &scratch)
+		if err != nil {
+			return malformedAt(recordStart, err)
+		}
+		id := IdentityHash(xxhash.Sum64(name))
+		pos = next + len(dialect.Delimiter)
+		// Read timestamp
+		tsStart := pos
+		tsEnd, ok := dialect.nextDelimiter(data, pos)
+		if !ok {
+			// Likely a plain name and measurement record
+			return malformedAt(recordStart, fmt.Errorf("missing timestamp column in %q, TIME_WINDOW expects name%[2]stimestamp%[2]smeasurement", lineAt(data, recordStart), dialect.Delimiter))
+		}
+		epoch, err := ParseTimestamp(data[tsStart:tsEnd])
+		if err != nil {
+			return malformedAt(recordStart, err)
+		}
+		key := TimedKey{Id: id, Bucket: window.BucketStart(epoch)}
+		pos = tsEnd + len(dialect.Delimiter)
+		if pos >= end {
+			return nameError(data, recordStart, dialect)
+		}
+		// Read measurement
+		measurement, next, ok := lookupMeasurement(data, pos, numberLookup)
+		if !ok {
+			if measurement, next, err = ParseDecimal1At(data, pos); err != nil {
+				return malformedAt(recordStart, err)
+			}
+		}
+		pos = next
+		// Update map, starting a new bucket like addMeasurement does a new station
+		item, ok := results[key]
+		if !ok {
+			item = &WeatherStationData{Id: id, Name: string(name), Min: measurement, Max: measurement}
+			results[key] = item
+		}
+		item.Update(measurement, thresholds)
+	}
+	return nil
+}
+
+func processTimedParallel(source ChunkSource, thresholds *Thresholds, dialect *Dialect, window TimeWindow, schedule *ScheduleOptions, timings *Timings) (TimedResults, error) {
+	endPhase := timings.Phase("lookup table")
+	lookup := PrepareDecimal1Lookup(dialect.LineEnding)
+	endPhase()
+	resultsCh := make(chan TimedResults, schedule.Workers)
+	group := newWorkerGroup()
+	timings.StartWorkers(schedule.Workers)
+	for worker := range schedule.Workers {
+		group.Go(func() error {
+			if err := schedule.pinWorker(worker); err != nil {
+				return err
+			}
+			timing := timings.Worker(worker)
+			results := TimedResults{}
+			endParse := timing.StartParse()
+			for offset, chunk := range source.Chunks(schedule.homeRegion(worker)) {
+				if group.Failed() {
+					return nil
+				}
+				timing.Chunk(len(chunk))
+				if err := IterTimedInto(chunk, results, &lookup, thresholds, dialect, window); err != nil {
+					return inChunk(err, offset)
+				}
+			}
+			endParse(results.Rows)
+			resultsCh <- results
+			return nil
+		})
+	}
+	stats, err := MergeAsFinished(resultsCh, schedule.Workers, group)
+	timings.WorkersDone()
+	return stats, err
+}
+
+func (p TimedResults) Rows() int64 {
+	rows := int64(0)
+	for _, item := range p {
+		rows += int64(item.Count)
+	}
+	return rows
+}
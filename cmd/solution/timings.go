@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"time"
+)
+
+// Where a run spends its time, for -timings. A nil *Timings records nothing, so callers
+// need no checks of their own. Phases are also runtime/trace regions, which -trace
+// records whether or not timings are on.
+type Timings struct {
+	start   time.Time
+	phases  []phaseTiming
+	workers []WorkerTiming
+	// When the workers were started, for the parse phase
+	launch time.Time
+}
+
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// Written only by its own worker.
+type WorkerTiming struct {
+	// Result table setup, before the first chunk
+	Alloc time.Duration
+	// From the first chunk request to the last chunk parsed. In streaming read modes this
+	// includes waiting for reads.
+	Parse  time.Duration
+	Chunks int
+	Bytes  int64
+	Rows   int64
+	// When parsing finished
+	end time.Time
+}
+
+func NewTimings() *Timings {
+	return &Timings{start: time.Now()}
+}
+
+// Starts a phase and returns the function that ends it. Phases run on the calling
+// goroutine, one at a time.
+func (t *Timings) Phase(name string) func() {
+	region := trace.StartRegion(context.Background(), name)
+	if t == nil {
+		return region.End
+	}
+	start := time.Now()
+	return func() {
+		region.End()
+		t.phases = append(t.phases, phaseTiming{name, time.Since(start)})
+	}
+}
+
+// Call right before starting count workers.
+func (t *Timings) StartWorkers(count int) {
+	if t == nil {
+		return
+	}
+	t.workers = make([]WorkerTiming, count)
+	t.launch = time.Now()
+}
+
+func (t *Timings) Worker(worker int) *WorkerTiming {
+	if t == nil {
+		return nil
+	}
+	return &t.workers[worker]
+}
+
+// Call once the merged results are in. Records parsing up to the last worker to finish
+// as one phase, and the merging left after that, which is all that merging adds to the
+// run since the rest overlaps with parsing.
+func (t *Timings) WorkersDone() {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	last := t.launch
+	for i := range t.workers {
+		if t.workers[i].end.After(last) {
+			last = t.workers[i].end
+		}
+	}
+	t.phases = append(t.phases, phaseTiming{"parse", last.Sub(t.launch)}, phaseTiming{"merge", now.Sub(last)})
+}
+
+// Starts the worker's parse region; the returned function takes the worker's row count.
+func (w *WorkerTiming) StartParse() func(rows func() int64) {
+	region := trace.StartRegion(context.Background(), "parse")
+	if w == nil {
+		return func(func() int64) { region.End() }
+	}
+	start := time.Now()
+	return func(rows func() int64) {
+		region.End()
+		w.end = time.Now()
+		w.Parse = w.end.Sub(start)
+		w.Rows = rows()
+	}
+}
+
+func (w *WorkerTiming) Chunk(size int) {
+	if w == nil {
+		return
+	}
+	w.Chunks++
+	w.Bytes += int64(size)
+}
+
+func (w *WorkerTiming) StartAlloc() func() {
+	if w == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		w.Alloc = time.Since(start)
+	}
+}
+
+// Phase summary, then one line per worker with its share of the parsing and how far
+// it is from the mean.
+func (t *Timings) Report(w io.Writer) {
+	if t == nil {
+		return
+	}
+	total := time.Since(t.start)
+	fmt.Fprintf(w, "%-20s %10s %7s\n", "Phase", "time", "share")
+	accounted := time.Duration(0)
+	for _, p := range t.phases {
+		fmt.Fprintf(w, "%-20s %8.1fms %6.1f%%\n", p.name, ms(p.duration), 100*p.duration.Seconds()/total.Seconds())
+		accounted += p.duration
+	}
+	fmt.Fprintf(w, "%-20s %8.1fms %6.1f%%\n", "other", ms(total-accounted), 100*(total-accounted).Seconds()/total.Seconds())
+	fmt.Fprintf(w, "%-20s %8.1fms\n", "total", ms(total))
+	if len(t.workers) == 0 {
+		return
+	}
+
+	var sumParse time.Duration
+	var sumRows int64
+	minParse, maxParse := t.workers[0].Parse, t.workers[0].Parse
+	for _, wt := range t.workers {
+		sumParse += wt.Parse
+		sumRows += wt.Rows
+		minParse, maxParse = min(minParse, wt.Parse), max(maxParse, wt.Parse)
+	}
+	meanParse := sumParse.Seconds() / float64(len(t.workers))
+	meanRows := float64(sumRows) / float64(len(t.workers))
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%6s %8s %10s %8s %7s %9s %11s %8s %8s\n", "Worker", "alloc", "parse", "vs mean", "chunks", "MB", "rows", "vs mean", "MB/s")
+	for i, wt := range t.workers {
+		throughput := 0.0
+		if wt.Parse > 0 {
+			throughput = float64(wt.Bytes) / 1e6 / wt.Parse.Seconds()
+		}
+		fmt.Fprintf(w, "%6d %6.1fms %8.1fms %+7.1f%% %7d %9.1f %11d %+7.1f%% %8.1f\n",
+			i, ms(wt.Alloc), ms(wt.Parse), relative(wt.Parse.Seconds(), meanParse), wt.Chunks,
+			float64(wt.Bytes)/1e6, wt.Rows, relative(float64(wt.Rows), meanRows), throughput)
+	}
+	fmt.Fprintf(w, "Parse time spread: %.1fms to %.1fms, slowest worker %.2fx the mean\n",
+		ms(minParse), ms(maxParse), maxParse.Seconds()/meanParse)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Percent difference from mean.
+func relative(v, mean float64) float64 {
+	if mean == 0 {
+		return 0
+	}
+	return 100 * (v/mean - 1)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Minimal io_uring over raw syscalls: one submission queue of fixed-buffer reads.
+
+const (
+	sysIoUringSetup    = 425
+	sysIoUringEnter    = 426
+	sysIoUringRegister = 427
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringFeatSingleMmap = 1 << 0
+	ioringEnterGetevents = 1 << 0
+	ioringRegisterBufs   = 0
+	ioringOpReadFixed    = 4
+)
+
+type ioSqringOffsets struct {
+	Head, Tail, RingMask, RingEntries, Flags, Dropped, Array, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type ioCqringOffsets struct {
+	Head, Tail, RingMask, RingEntries, Overflow, Cqes, Flags, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type ioUringParams struct {
+	SqEntries, CqEntries, Flags, SqThreadCpu, SqThreadIdle, Features, WqFd uint32
+	Resv                                                                   [3]uint32
+	SqOff                                                                  ioSqringOffsets
+	CqOff                                                                  ioCqringOffsets
+}
+
+type ioUringSqe struct {
+	Opcode      uint8
+	Flags       uint8
+	Ioprio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	RwFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	_           uint64
+}
+
+type ioUringCqe struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+type ioUring struct {
+	fd                     int
+	sqRing, cqRing, sqeMem []byte
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []ioUringSqe
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []ioUringCqe
+	// Completion queue shares the submission queue's mapping
+	singleMmap bool
+}
+
+func newIoUring(entries int) (*ioUring, error) {
+	var params ioUringParams
+	fd, _, errno := syscall.Syscall(sysIoUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	r := &ioUring{fd: int(fd), singleMmap: params.Features&ioringFeatSingleMmap != 0}
+	sqSize := int(params.SqOff.Array) + int(params.SqEntries)*4
+	cqSize := int(params.CqOff.Cqes) + int(params.CqEntries)*int(unsafe.Sizeof(ioUringCqe{}))
+	if r.singleMmap {
+		sqSize = max(sqSize, cqSize)
+	}
+	var err error
+	if r.sqRing, err = mmapRing(r.fd, sqSize, ioringOffSqRing); err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.cqRing = r.sqRing
+	if !r.singleMmap {
+		if r.cqRing, err = mmapRing(r.fd, cqSize, ioringOffCqRing); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if r.sqeMem, err = mmapRing(r.fd, int(params.SqEntries)*int(unsafe.Sizeof(ioUringSqe{})), ioringOffSqes); err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[params.SqOff.Head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.SqOff.Tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[params.SqOff.RingMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[params.SqOff.Array])), params.SqEntries)
+	r.sqes = unsafe.Slice((*ioUringSqe)(unsafe.Pointer(&r.sqeMem[0])), params.SqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.CqOff.Head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.CqOff.Tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[params.CqOff.RingMask]))
+	r.cqes = unsafe.Slice((*ioUringCqe)(unsafe.Pointer(&r.cqRing[params.CqOff.Cqes])), params.CqEntries)
+	return r, nil
+}
+
+func mmapRing(fd int, size int, offset int64) ([]byte, error) {
+	data, err := syscall.Mmap(fd, offset, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return nil, fmt.Errorf("mmap io_uring ring: %w", err)
+	}
+	return data, nil
+}
+
+func (r *ioUring) registerBuffers(buffers [][]byte) error {
+	iovecs := make([]syscall.Iovec, len(buffers))
+	for i, buf := range buffers {
+		iovecs[i].Base = &buf[0]
+		iovecs[i].SetLen(len(buf))
+	}
+	_, _, errno := syscall.Syscall6(sysIoUringRegister, uintptr(r.fd), ioringRegisterBufs,
+		uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("io_uring_register buffers: %w", errno)
+	}
+	return nil
+}
+
+// Queues a read of len(buf) bytes at offset into registered buffer bufIndex. Returns
+// false when the submission queue is full.
+func (r *ioUring) queueReadFixed(fd int, buf []byte, bufIndex int, offset int64, userData uint64) bool {
+	tail := *r.sqTail
+	if tail-atomic.LoadUint32(r.sqHead) == uint32(len(r.sqes)) {
+		return false
+	}
+	index := tail & *r.sqMask
+	r.sqes[index] = ioUringSqe{
+		Opcode:   ioringOpReadFixed,
+		Fd:       int32(fd),
+		Off:      uint64(offset),
+		Addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		Len:      uint32(len(buf)),
+		UserData: userData,
+		BufIndex: uint16(bufIndex),
+	}
+	r.sqArray[index] = index
+	atomic.StoreUint32(r.sqTail, tail+1)
+	return true
+}
+
+// Submits queued reads and waits for at least minComplete completions.
+func (r *ioUring) enter(toSubmit int, minComplete int) error {
+	flags := uintptr(0)
+	if minComplete > 0 {
+		flags = ioringEnterGetevents
+	}
+	for {
+		_, _, errno := syscall.Syscall6(sysIoUringEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), flags, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return fmt.Errorf("io_uring_enter: %w", errno)
+		}
+		return nil
+	}
+}
+
+// Completions ready so far, consumed as they are yielded.
+func (r *ioUring) completions() iter.Seq[ioUringCqe] {
+	return func(yield func(ioUringCqe) bool) {
+		head := *r.cqHead
+		for head != atomic.LoadUint32(r.cqTail) {
+			cqe := r.cqes[head&*r.cqMask]
+			head++
+			atomic.StoreUint32(r.cqHead, head)
+			if !yield(cqe) {
+				return
+			}
+		}
+	}
+}
+
+func (r *ioUring) Close() error {
+	if r.sqeMem != nil {
+		syscall.Munmap(r.sqeMem)
+	}
+	if r.cqRing != nil && !r.singleMmap {
+		syscall.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		syscall.Munmap(r.sqRing)
+	}
+	return syscall.Close(r.fd)
+}
+
+// Reads the file as fixed size blocks through io_uring, many in flight at once and
+// completing in any order. Each completed block is handed to workers minus its first
+// and last partial record; those are stitched with the neighbouring block's as soon as
+// both sides are in, so no block waits for its predecessor.
+type UringReader struct {
+	file      *os.File
+	size      int64
+	blockSize int
+	skipFirst bool
+	ring      *ioUring
+	bufMem    []byte
+	buffers   [][]byte
+	free      chan int
+	filled    chan uringChunk
+	// Partial records at the start (heads) and end (tails) of each block, by block index
+	heads, tails map[int][]byte
+	err          error
+	running      bool
+}
+
+type uringChunk struct {
+	// Buffer to return once parsed, -1 for stitched records
+	buffer int
+	data   []byte
+	// File offset of data
+	offset int64
+}
+
+func NewUringReader(filename string, blockSize int, buffers int, skipFirstLine bool) (*UringReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ring, err := newIoUring(buffers)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &UringReader{
+		file:      f,
+		size:      fi.Size(),
+		blockSize: blockSize,
+		skipFirst: skipFirstLine,
+		ring:      ring,
+		free:      make(chan int, buffers),
+		filled:    make(chan uringChunk, 2*buffers+1),
+		heads:     map[int][]byte{},
+		tails:     map[int][]byte{},
+	}
+	stride := blockSize + streamPadSize
+	if r.bufMem, err = syscall.Mmap(-1, 0, stride*buffers,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS); err != nil {
+		r.Close()
+		return nil, err
+	}
+	for i := range buffers {
+		r.buffers = append(r.buffers, r.bufMem[i*stride:(i+1)*stride])
+		r.free <- i
+	}
+	if err := ring.registerBuffers(r.buffers); err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.running = true
+	go r.run()
+	return r, nil
+}
+
+func (r *UringReader) run() {
+	defer close(r.filled)
+	blocks := int((r.size + int64(r.blockSize) - 1) / int64(r.blockSize))
+	// Buffer each in-flight block is being read into
+	inFlight := map[int]int{}
+	// Bytes read so far into each in-flight block, and blocks whose last read came up
+	// short and still need the rest queued
+	got := map[int]int{}
+	var short []int
+	next, done := 0, 0
+	for done < blocks {
+		queued := 0
+		for len(short) > 0 {
+			block := short[0]
+			buffer := inFlight[block]
+			offset, length := r.blockRange(block)
+			if !r.ring.queueReadFixed(int(r.file.Fd()), r.buffers[buffer][got[block]:length], buffer, offset+int64(got[block]), uint64(block)) {
+				break
+			}
+			short = short[1:]
+			queued++
+		}
+	fill:
+		for next < blocks {
+			var buffer int
+			select {
+			case buffer = <-r.free:
+			default:
+				if len(inFlight) > 0 {
+					break fill
+				}
+				// Everything is with the workers, wait for one to finish a block
+				buffer = <-r.free
+			}
+			offset, length := r.blockRange(next)
+			if !r.ring.queueReadFixed(int(r.file.Fd()), r.buffers[buffer][:length], buffer, offset, uint64(next)) {
+				r.free <- buffer
+				break
+			}
+			inFlight[next] = buffer
+			next++
+			queued++
+		}
+		if err := r.ring.enter(queued, 1); err != nil {
+			r.err = err
+			return
+		}
+		for cqe := range r.ring.completions() {
+			block := int(cqe.UserData)
+			buffer := inFlight[block]
+			offset, length := r.blockRange(block)
+			if cqe.Res < 0 {
+				r.err = fmt.Errorf("io_uring read at offset %d: %w", offset+int64(got[block]), syscall.Errno(-cqe.Res))
+				return
+			}
+			if cqe.Res == 0 {
+				r.err = fmt.Errorf("io_uring read at offset %d: unexpected end of file", offset+int64(got[block]))
+				return
+			}
+			// Reads may return less than asked, e.g. after a signal; queue the rest into the
+			// same buffer
+			if got[block] += int(cqe.Res); got[block] < length {
+				short = append(short, block)
+				continue
+			}
+			delete(inFlight, block)
+			delete(got, block)
+			if err := r.complete(block, blocks, r.buffers[buffer][:length], buffer); err != nil {
+				r.err = err
+				return
+			}
+			done++
+		}
+	}
+}
+
+// File offset and length of block.
+func (r *UringReader) blockRange(block int) (int64, int) {
+	offset := int64(block) * int64(r.blockSize)
+	return offset, int(min(int64(r.blockSize), r.size-offset))
+}
+
+// Splits a completed block into head, body and tail, handing the body to workers and
+// stitching the head and tail with the neighbouring blocks where those are in.
+func (r *UringReader) complete(block int, blocks int, data []byte, buffer int) error {
+	start := 0
+	if block > 0 || r.skipFirst {
+		start = bytes.IndexByte(data, '\n') + 1
+		if start == 0 {
+			return fmt.Errorf("no line break in %d byte block %d, records must be shorter than a block", len(data), block)
+		}
+	}
+	end := len(data)
+	if block < blocks-1 {
+		end = bytes.LastIndexByte(data, '\n') + 1
+	}
+	// end may precede start if the block holds a single line break
+	end = max(start, end)
+	if block > 0 {
+		r.heads[block] = bytes.Clone(data[:start])
+		r.stitch(block)
+	}
+	if block < blocks-1 {
+		r.tails[block] = bytes.Clone(data[end:])
+		r.stitch(block + 1)
+	}
+	if end > start {
+		offset, _ := r.blockRange(block)
+		r.filled <- uringChunk{buffer: buffer, data: data[start:end], offset: offset + int64(start)}
+	} else {
+		r.free <- buffer
+	}
+	return nil
+}
+
+// Emits the record spanning the boundary between block-1 and block once both halves
+// are known.
+func (r *UringReader) stitch(block int) {
+	tail, haveTail := r.tails[block-1]
+	head, haveHead := r.heads[block]
+	if !haveTail || !haveHead {
+		return
+	}
+	delete(r.tails, block-1)
+	delete(r.heads, block)
+	record := make([]byte, 0, len(tail)+len(head)+streamPadSize)
+	record = append(append(record, tail...), head...)
+	if len(record) > 0 {
+		offset, _ := r.blockRange(block)
+		r.filled <- uringChunk{buffer: -1, data: record, offset: offset - int64(len(tail))}
+	}
+}
+
+func (r *UringReader) Chunks(home int) iter.Seq2[int64, []byte] {
+	return func(yield func(int64, []byte) bool) {
+		for chunk := range r.filled {
+			more := yield(chunk.offset, chunk.data)
+			if chunk.buffer >= 0 {
+				r.free <- chunk.buffer
+			}
+			if !more {
+				return
+			}
+		}
+	}
+}
+
+// Read error that ended the stream early, if any. Only valid once Chunks is exhausted.
+func (r *UringReader) Err() error {
+	return r.err
+}
+
+func (r *UringReader) Close() error {
+	if r.running {
+		// As in StreamReader.Close, finish reading before the buffers go away
+		for range r.Chunks(0) {
+		}
+		r.running = false
+	}
+	if r.ring != nil {
+		r.ring.Close()
+	}
+	if r.bufMem != nil {
+		syscall.Munmap(r.bufMem)
+	}
+	return r.file.Close()
+}
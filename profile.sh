@@ -1,5 +1,4 @@
 set -e
 ./build.sh
-rm -f ./solution.prof
-PROFILE=yep ./solution $1 > /dev/null
+./solution -cpuprofile ./solution.prof $1 > /dev/null
 go tool pprof -top ./solution ./solution.prof | head -n 20